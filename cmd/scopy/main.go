@@ -2,30 +2,79 @@ package main
 
 import (
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
-	"strings"
+	"slices"
+	"time"
 
 	tp "scopy/pkg/transport"
 	"scopy/pkg/util"
 
 	"github.com/alecthomas/kong"
-	"github.com/pkg/sftp"
-	"golang.org/x/crypto/ssh"
 )
 
 var args struct {
-	Source        string           `arg:"" name:"source" help:"來源路徑"`
-	Target        string           `arg:"" name:"target" help:"目的路徑"`
-	Exclude       []string         `short:"x" help:"排除的檔案或目錄模式 (pattern), 可用萬用字元"`
-	Port          uint16           `default:"22" help:"SSH 埠號. 預設 22"`
-	Key           string           `short:"k" help:"私鑰的檔案位置"`
-	ForcePassword bool             `help:"強迫使用密碼"`
-	Version       kong.VersionFlag `short:"V" help:"顯示版本訊息"`
+	Paths                 []string         `arg:"" name:"source... target" help:"來源路徑, 最後一個是目的路徑. 可以有多個來源, 都在本地或同一台遠端主機上, 可用萬用字元; 有多個來源時目的路徑必須是目錄. - 表示標準輸入或標準輸出"`
+	Exclude               []string         `short:"x" help:"排除的檔案或目錄模式 (pattern), 可用萬用字元"`
+	Jobs                  int              `short:"j" default:"1" help:"同時傳輸的檔案數. 預設 1"`
+	Streams               int              `default:"1" help:"大檔案分段同時傳輸的數量. 預設 1 (不分段)"`
+	ChunkSize             byteSize         `default:"64M" help:"分段的大小, 可加上 K, M, G 單位. 預設 64M"`
+	Connections           int              `default:"1" help:"建立幾條 SSH 連線, 分段會輪流使用. 預設 1"`
+	Resume                bool             `help:"目的檔是中斷的複製結果時, 從它的結尾繼續"`
+	ResumeCheck           bool             `help:"續傳前比對已複製部分的最後一個區塊 (1 MiB), 不同時重新複製. 包含 --resume"`
+	Inplace               bool             `help:"直接寫入目的檔, 不經過暫存檔再改名"`
+	Incremental           bool             `short:"i" help:"略過大小與修改時間都和來源檔相同的目的檔"`
+	Update                bool             `xor:"skip" help:"略過比來源檔新的目的檔. 包含 --incremental"`
+	IgnoreExisting        bool             `xor:"skip,compare" help:"略過已經存在的目的檔"`
+	SizeOnly              bool             `xor:"skip,compare" help:"略過大小和來源檔相同的目的檔, 不比較修改時間"`
+	Checksum              bool             `xor:"compare" help:"以內容 (SHA-256) 而不是修改時間判斷檔案是否變更. 包含 --incremental"`
+	Delta                 bool             `help:"目的檔存在時只傳送不同的部分, 遠端必須有 scopy"`
+	DeltaHelper           string           `default:"scopy" help:"遠端 scopy 的路徑. 預設 scopy"`
+	Delete                bool             `help:"複製目錄後刪除目的地中來源沒有的項目, 符合 -x 的項目不會刪除"`
+	DeleteDryRun          bool             `help:"只列出 --delete 會刪除的項目, 不真的刪除. 包含 --delete"`
+	MaxDelete             int              `help:"--delete 最多刪除的項目數, 超過時一個也不刪除. 預設 0 (沒有限制)"`
+	DryRun                bool             `short:"n" help:"只列出會做的動作 (建立目錄, 複製, 略過, 刪除), 不修改本地與遠端"`
+	Progress              bool             `short:"P" help:"顯示每個檔案與整體的傳輸進度, 速度與剩餘時間. 輸出不是終端機時每 5 秒顯示一次"`
+	Verify                bool             `help:"複製後比對兩邊的 SHA-256 (遠端以 SFTP 的 check-file 或 sha256sum 計算, 都不支援時改為讀取遠端檔案), 有不同時以錯誤結束"`
+	LimitRate             byteSize         `placeholder:"RATE" help:"每秒最多傳輸的位元組數, 同時傳輸的所有檔案合計, 可加上 K, M, G 單位. 預設依照 ~/.ssh/config 的 LimitRate, 否則不限制"`
+	Port                  uint16           `help:"SSH 埠號. 預設依照 ~/.ssh/config, 否則為 22"`
+	Key                   []string         `short:"k" sep:"none" help:"私鑰的檔案位置, 可以指定多次. 另外會嘗試 ~/.ssh/config 的 IdentityFile 或預設的私鑰"`
+	ForcePassword         bool             `help:"強迫使用密碼"`
+	PasswordFile          string           `help:"從檔案的第一行讀取登入密碼"`
+	PasswordEnv           string           `help:"從環境變數讀取登入密碼, 例如 --password-env SCOPY_PASSWORD"`
+	PassphraseFile        string           `help:"從檔案的第一行讀取私鑰密碼"`
+	PassphraseEnv         string           `help:"從環境變數讀取私鑰密碼"`
+	NoAgent               bool             `help:"不使用 ssh-agent 中的身分"`
+	ForwardAgent          bool             `short:"A" help:"轉送 ssh-agent 到遠端, 只有 --direct 在來源主機執行的 scp 會使用 (--direct 已經包含)"`
+	Direct                bool             `help:"遠端之間複製時, 在來源主機執行 scp 直接推送到目的主機, 資料不經過本地. 以轉送的 ssh-agent 認證, 包含 -A"`
+	Jump                  string           `short:"J" help:"經由跳板主機連線, 多台以逗號分隔, 如 user@bastion:22,gateway"`
+	Proxy                 string           `help:"經由代理伺服器連線, 如 socks5://[user:pass@]host:1080 或 http://host:3128"`
+	ProxyCommand          string           `help:"以指令的 stdin/stdout 作為連線, %h, %p, %r 代表主機, 埠號與使用者"`
+	ConnectTimeout        time.Duration    `help:"建立連線與交握的時限, 如 10s. 預設依照 ~/.ssh/config 的 ConnectTimeout, 否則為 30s"`
+	ServerAliveInterval   time.Duration    `help:"送出 keepalive 的間隔. 預設依照 ~/.ssh/config, 否則為 30s"`
+	ServerAliveCountMax   int              `help:"連續幾次 keepalive 沒有回應就視為斷線. 預設依照 ~/.ssh/config, 否則為 3"`
+	Reconnects            int              `default:"3" help:"連線中斷時最多重新連線的次數, 0 表示不重新連線. 預設 3"`
+	Ciphers               string           `short:"c" help:"加密演算法, 以逗號分隔. 以 + 開頭加在預設之後, - 開頭從預設移除, ^ 開頭放在預設之前"`
+	KexAlgorithms         string           `help:"金鑰交換演算法, 規則同 --ciphers"`
+	MACs                  string           `name:"macs" help:"MAC 演算法, 規則同 --ciphers"`
+	HostKeyAlgorithms     string           `help:"主機金鑰演算法, 規則同 --ciphers"`
+	Verbose               bool             `short:"v" help:"顯示連線細節, 如協商的演算法"`
+	StrictHostKeyChecking string           `default:"ask" enum:"ask,yes,no,accept-new" help:"主機金鑰檢查模式 (ask, yes, no, accept-new). 預設 ask"`
+	Version               kong.VersionFlag `short:"V" help:"顯示版本訊息"`
 }
 
 func main() {
-	kong.Parse(
+	// 在遠端作為差異傳輸的輔助程式執行
+	if len(os.Args) == 2 && os.Args[1] == tp.DeltaServerFlag {
+		if err := tp.ServeDelta(os.Stdin, os.Stdout); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	ctx := kong.Parse(
 		&args,
 		kong.Name(filepath.Base(os.Args[0])),
 		kong.Description(fmt.Sprintf("A simplified scp tool (%s commit %s)", VersionString, GitCommitHash)),
@@ -37,24 +86,127 @@ func main() {
 		kong.Vars{"version": fmt.Sprintf("%s (commit %s)", VersionString, GitCommitHash)},
 	)
 
-	srcInfo := tp.ParseScpCli(args.Source)
-	dstInfo := tp.ParseScpCli(args.Target)
+	if len(args.Paths) < 2 {
+		ctx.FatalIfErrorf(fmt.Errorf("需要來源與目的路徑"))
+	}
+
+	// 最後一個路徑是目的路徑, 之前的都是來源
+	dstInfo := tp.ParseScpCli(args.Paths[len(args.Paths)-1])
+	var srcInfos []tp.ScpInfo
+	for _, path := range args.Paths[:len(args.Paths)-1] {
+		srcInfos = append(srcInfos, tp.ParseScpCli(path))
+	}
+	srcInfo := srcInfos[0]
+
+	// 所有的來源共用同一條連線
+	for _, info := range srcInfos[1:] {
+		if info.Address != srcInfo.Address || info.Username != srcInfo.Username {
+			exit("所有的來源必須都在本地, 或都在同一台遠端主機上.")
+		}
+	}
+	if len(srcInfos) > 1 && (dstInfo.IsStdio() || slices.ContainsFunc(srcInfos, tp.ScpInfo.IsStdio)) {
+		exit("有多個來源時不能使用 -.")
+	}
+
+	// 檔案內容寫到標準輸出時, 訊息與進度改為顯示在標準錯誤
+	if dstInfo.IsStdio() {
+		messages = os.Stderr
+		tp.SetMessageOutput(os.Stderr)
+	}
+
+	connOpts := tp.ConnectOptions{
+		Port:                  args.Port,
+		Keys:                  args.Key,
+		ForcePassword:         args.ForcePassword,
+		PasswordFile:          args.PasswordFile,
+		PasswordEnv:           args.PasswordEnv,
+		PassphraseFile:        args.PassphraseFile,
+		PassphraseEnv:         args.PassphraseEnv,
+		StrictHostKeyChecking: args.StrictHostKeyChecking,
+		NoAgent:               args.NoAgent,
+		ForwardAgent:          args.ForwardAgent,
+		ProxyJump:             args.Jump,
+		ProxyCommand:          args.ProxyCommand,
+		Proxy:                 args.Proxy,
+		ConnectTimeout:        args.ConnectTimeout,
+		ServerAliveInterval:   args.ServerAliveInterval,
+		ServerAliveCountMax:   args.ServerAliveCountMax,
+		Reconnects:            args.Reconnects,
+		Ciphers:               args.Ciphers,
+		KexAlgorithms:         args.KexAlgorithms,
+		MACs:                  args.MACs,
+		HostKeyAlgorithms:     args.HostKeyAlgorithms,
+		Verbose:               args.Verbose,
+	}
+
+	transferOpts := tp.TransferOptions{
+		Excludes:  args.Exclude,
+		Jobs:      args.Jobs,
+		Streams:   args.Streams,
+		ChunkSize: int64(args.ChunkSize),
+
+		Resume:      args.Resume || args.ResumeCheck,
+		ResumeCheck: args.ResumeCheck,
+		Inplace:     args.Inplace,
+
+		Skip:     skipPolicy(),
+		Checksum: args.Checksum,
+
+		Delta:       args.Delta,
+		DeltaHelper: args.DeltaHelper,
+
+		Delete:       args.Delete || args.DeleteDryRun,
+		DeleteDryRun: args.DeleteDryRun,
+		MaxDelete:    args.MaxDelete,
+
+		DryRun:   args.DryRun,
+		Progress: args.Progress,
+		Verify:   args.Verify,
+
+		LimitRate: int64(args.LimitRate),
+	}
+
+	// 沒有指定 --limit-rate 時依照 ssh 設定檔中遠端主機的 LimitRate, 兩端的主機都有設定時取較小的
+	if transferOpts.LimitRate == 0 {
+		for _, address := range []string{srcInfo.Address, dstInfo.Address} {
+			if address == "" {
+				continue
+			}
+
+			hostConfig, err := tp.LoadHostConfig(address)
+			if err != nil {
+				exit("讀取 ssh 設定檔時發生錯誤: %s.", err)
+			}
+			if limit := hostConfig.LimitRate; limit > 0 && (transferOpts.LimitRate == 0 || limit < transferOpts.LimitRate) {
+				transferOpts.LimitRate = limit
+			}
+		}
+	}
+
+	if len(srcInfo.Address) > 0 && len(dstInfo.Address) > 0 {
+		copyBetweenRemotes(srcInfos, dstInfo, connOpts, transferOpts)
+		return
+	}
+	rejectFlags("本地與遠端之間複製", flagUse{"--direct", args.Direct})
 
 	var (
-		remote     *ssh.Client
+		remote     *tp.Remote
 		err        error
 		isDownload bool
 	)
-	if len(srcInfo.Username) > 0 && len(srcInfo.Address) > 0 {
-		remote, err = tp.Connect(srcInfo.Address, args.Port, srcInfo.Username, args.Key, args.ForcePassword)
+	// 遠端的使用者名稱可以省略, 由 ~/.ssh/config 或本地使用者名稱決定
+	if len(srcInfo.Address) > 0 {
+		connOpts.Username = srcInfo.Username
+		remote, err = tp.Dial(srcInfo.Address, connOpts)
 		if err != nil {
 			exit("連線至 %s 時發生錯誤: %v.", srcInfo.Address, err)
 		} else {
 			defer remote.Close()
 			isDownload = true
 		}
-	} else if len(dstInfo.Username) > 0 && len(dstInfo.Address) > 0 {
-		remote, err = tp.Connect(dstInfo.Address, args.Port, dstInfo.Username, args.Key, args.ForcePassword)
+	} else if len(dstInfo.Address) > 0 {
+		connOpts.Username = dstInfo.Username
+		remote, err = tp.Dial(dstInfo.Address, connOpts)
 		if err != nil {
 			exit("連線至 %s 時發生錯誤: %s.", dstInfo.Address, err)
 		} else {
@@ -64,45 +216,186 @@ func main() {
 		exit("沒有或不正確地設定遠端.")
 	}
 
-	if client, err := sftp.NewClient(remote); err != nil {
-		exit("無法建立 SFTP: %s.", err)
-	} else {
-		defer client.Close()
-
-		path, err := client.RealPath(".")
-		if err != nil {
-			exit("嘗試檢查遠端時發生錯誤: %s.", err)
+	if args.Connections > 1 {
+		if err := remote.AddConnections(args.Connections - 1); err != nil {
+			exit("建立額外的連線時發生錯誤: %s.", err)
 		}
-		remoteSep := "\\"
-		if strings.HasPrefix(path, "/") {
-			remoteSep = "/"
+	}
+
+	if isDownload {
+		srcPaths := expandRemote(remote, srcInfos)
+		multiple := len(srcPaths) > 1
+		if multiple && !util.IsDirectory(dstInfo.Path) {
+			exit("有多個來源時, 目的路徑 %s 必須是已經存在的目錄.", dstInfo.Path)
 		}
 
-		if isDownload {
-			if _, err := client.Stat(srcInfo.Path); err != nil {
+		for _, srcPath := range srcPaths {
+			srcStat, err := remote.Client().Stat(srcPath)
+			if err != nil {
 				if os.IsNotExist(err) {
-					exit("遠端路徑 %s 不存在.", srcInfo.Path)
+					exit("遠端路徑 %s 不存在.", srcPath)
 				} else {
 					exit("取得遠端路徑資訊時發生錯誤: %s.", err)
 				}
-			} else {
-				if err := tp.Download(client, srcInfo.Path, dstInfo.Path, args.Exclude, remoteSep); err != nil {
-					exit("下載時發生錯誤: %s.", err)
-				}
 			}
-		} else {
-			if !util.PathExists(srcInfo.Path) {
-				exit("本地路徑 %s 不存在.", srcInfo.Path)
+
+			localPath := targetPath(srcPath, srcStat.IsDir(), dstInfo.Path, multiple)
+			if err := tp.Download(remote, srcPath, localPath, transferOpts); err != nil {
+				exit("下載時發生錯誤: %s.", err)
+			}
+		}
+	} else {
+		srcPaths := expandLocal(srcInfos)
+		multiple := len(srcPaths) > 1
+		if multiple {
+			checkRemoteDirectory(remote, dstInfo.Path)
+		}
+
+		for _, srcPath := range srcPaths {
+			if srcPath != tp.StdioPath && !util.PathExists(srcPath) {
+				exit("本地路徑 %s 不存在.", srcPath)
 			}
 
-			if err := tp.Upload(client, dstInfo.Path, srcInfo.Path, args.Exclude, remoteSep); err != nil {
+			remotePath := targetPath(srcPath, util.IsDirectory(srcPath), dstInfo.Path, multiple)
+			if err := tp.Upload(remote, remotePath, srcPath, transferOpts); err != nil {
 				exit("上傳時發生錯誤: %s.", err)
 			}
 		}
 	}
 }
 
+// copyBetweenRemotes 在兩台遠端主機之間複製. 預設經由本地轉送, --direct 時由來源主機直接推送到目的主機.
+func copyBetweenRemotes(srcInfos []tp.ScpInfo, dstInfo tp.ScpInfo, connOpts tp.ConnectOptions, transferOpts tp.TransferOptions) {
+	srcInfo := srcInfos[0]
+	srcOpts, dstOpts := connOpts, connOpts
+	srcOpts.Username, dstOpts.Username = srcInfo.Username, dstInfo.Username
+
+	if args.Direct {
+		rejectFlags("--direct",
+			flagUse{"-x", len(args.Exclude) > 0},
+			flagUse{"-j", args.Jobs > 1},
+			flagUse{"--streams", args.Streams > 1},
+			flagUse{"--connections", args.Connections > 1},
+			flagUse{"--resume", args.Resume || args.ResumeCheck},
+			flagUse{"--inplace", args.Inplace},
+			flagUse{"增量複製", transferOpts.Skip != tp.SkipNone},
+			flagUse{"--delta", args.Delta},
+			flagUse{"--delete", transferOpts.Delete},
+			flagUse{"-P", args.Progress},
+			flagUse{"--verify", args.Verify},
+		)
+
+		// 來源主機以轉送的 ssh-agent 連線到目的主機
+		srcOpts.ForwardAgent = true
+		src, err := tp.Dial(srcInfo.Address, srcOpts)
+		if err != nil {
+			exit("連線至 %s 時發生錯誤: %s.", srcInfo.Address, err)
+		}
+		defer src.Close()
+
+		// 遠端的 scp 不會展開萬用字元, 先在這裡展開
+		srcPaths := expandRemote(src, srcInfos)
+		if err := tp.CopyDirect(src, srcPaths, dstInfo.Address, dstInfo.Path, dstOpts, transferOpts); err != nil {
+			exit("複製時發生錯誤: %s.", err)
+		}
+		return
+	}
+
+	rejectFlags("遠端之間複製",
+		flagUse{"--streams", args.Streams > 1},
+		flagUse{"--connections", args.Connections > 1},
+		flagUse{"--resume", args.Resume || args.ResumeCheck},
+		flagUse{"--delta", args.Delta},
+	)
+
+	src, err := tp.Dial(srcInfo.Address, srcOpts)
+	if err != nil {
+		exit("連線至 %s 時發生錯誤: %s.", srcInfo.Address, err)
+	}
+	defer src.Close()
+
+	dst, err := tp.Dial(dstInfo.Address, dstOpts)
+	if err != nil {
+		exit("連線至 %s 時發生錯誤: %s.", dstInfo.Address, err)
+	}
+	defer dst.Close()
+
+	srcPaths := expandRemote(src, srcInfos)
+	multiple := len(srcPaths) > 1
+	if multiple {
+		checkRemoteDirectory(dst, dstInfo.Path)
+	}
+
+	for _, srcPath := range srcPaths {
+		srcStat, err := src.Client().Stat(srcPath)
+		if err != nil {
+			if os.IsNotExist(err) {
+				exit("遠端路徑 %s 不存在.", srcPath)
+			} else {
+				exit("取得遠端路徑資訊時發生錯誤: %s.", err)
+			}
+		}
+
+		dstPath := targetPath(srcPath, srcStat.IsDir(), dstInfo.Path, multiple)
+		if err := tp.CopyRemote(src, srcPath, dst, dstPath, transferOpts); err != nil {
+			exit("複製時發生錯誤: %s.", err)
+		}
+	}
+}
+
+// flagUse 記錄一個命令列參數是否有設定
+type flagUse struct {
+	name string
+	set  bool
+}
+
+// rejectFlags 有設定 flags 中任何一個時結束, how 是目前的複製方式
+func rejectFlags(how string, flags ...flagUse) {
+	for _, flag := range flags {
+		if flag.set {
+			exit("%s: 不支援 %s.", how, flag.name)
+		}
+	}
+}
+
+// skipPolicy 依照命令列參數決定略過目的檔的規則
+func skipPolicy() string {
+	switch {
+	case args.IgnoreExisting:
+		return tp.SkipExisting
+	case args.SizeOnly:
+		return tp.SkipSizeOnly
+	case args.Update:
+		return tp.SkipUpdate
+	case args.Incremental || args.Checksum:
+		return tp.SkipUnchanged
+	}
+
+	return tp.SkipNone
+}
+
+// byteSize 是可以加上 K, M, G 單位的位元組數, 如 64M
+type byteSize int64
+
+func (s *byteSize) Decode(ctx *kong.DecodeContext) error {
+	var value string
+	if err := ctx.Scan.PopValueInto("size", &value); err != nil {
+		return err
+	}
+
+	size, err := util.ParseSize(value)
+	if err != nil {
+		return err
+	}
+	*s = byteSize(size)
+
+	return nil
+}
+
+// messages 是 exit 顯示訊息的位置
+var messages io.Writer = os.Stdout
+
 func exit(format string, a ...any) {
-	fmt.Printf(format, a...)
+	fmt.Fprintf(messages, format, a...)
 	os.Exit(1)
 }
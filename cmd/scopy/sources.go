@@ -0,0 +1,73 @@
+package main
+
+import (
+	"path/filepath"
+
+	tp "scopy/pkg/transport"
+	"scopy/pkg/util"
+)
+
+// expandLocal 展開本地來源中的萬用字元. Unix 的 shell 通常已經展開, 但 Windows 的命令列不會.
+// 路徑本身存在或沒有萬用字元時維持原樣, 之後再檢查是否存在.
+func expandLocal(infos []tp.ScpInfo) []string {
+	var paths []string
+	for _, info := range infos {
+		if info.IsStdio() || util.PathExists(info.Path) || !util.HasGlobMeta(info.Path) {
+			paths = append(paths, info.Path)
+			continue
+		}
+
+		matches, err := filepath.Glob(info.Path)
+		if err != nil {
+			exit("本地路徑 %s 不正確: %s.", info.Path, err)
+		} else if len(matches) == 0 {
+			exit("本地路徑 %s 不存在.", info.Path)
+		}
+		paths = append(paths, matches...)
+	}
+
+	return paths
+}
+
+// expandRemote 展開遠端來源中的萬用字元, 依照名稱排序
+func expandRemote(remote *tp.Remote, infos []tp.ScpInfo) []string {
+	var paths []string
+	for _, info := range infos {
+		matches, err := remote.Glob(info.Path)
+		if err != nil {
+			exit("取得遠端路徑資訊時發生錯誤: %s.", err)
+		} else if len(matches) == 0 {
+			exit("遠端路徑 %s 不存在.", info.Path)
+		}
+		paths = append(paths, matches...)
+	}
+
+	return paths
+}
+
+// checkRemoteDirectory 確認有多個來源時, 遠端的目的路徑是已經存在的目錄
+func checkRemoteDirectory(remote *tp.Remote, dstPath string) {
+	if isDir, err := util.RemoteIsDirectory(remote.Client(), dstPath); err != nil {
+		exit("取得遠端路徑資訊時發生錯誤: %s.", err)
+	} else if !isDir {
+		exit("有多個來源時, 目的路徑 %s 必須是已經存在的目錄.", dstPath)
+	}
+}
+
+// targetPath 傳回來源 srcPath 的目的路徑. 只有一個來源時直接使用 dstPath, 來源目錄的內容複製到 dstPath 中;
+// 有多個來源時, 目錄複製到 dstPath 中同名的子目錄, 檔案則放進 dstPath 目錄.
+func targetPath(srcPath string, isDir bool, dstPath string, multiple bool) string {
+	if !multiple || !isDir {
+		return dstPath
+	}
+
+	// 本地的 . 或 .. 以實際的目錄名稱為準
+	name := filepath.Base(srcPath)
+	if name == "." || name == ".." {
+		if abs, err := filepath.Abs(srcPath); err == nil {
+			name = filepath.Base(abs)
+		}
+	}
+
+	return filepath.Join(dstPath, name)
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	tp "scopy/pkg/transport"
+)
+
+func TestTargetPath(t *testing.T) {
+	dir := t.TempDir()
+	t.Chdir(dir)
+
+	tests := []struct {
+		name     string
+		srcPath  string
+		isDir    bool
+		multiple bool
+		want     string
+	}{
+		{name: "單一檔案", srcPath: "/data/a.txt", want: "/backup"},
+		{name: "單一目錄複製內容", srcPath: "/data/logs", isDir: true, want: "/backup"},
+		{name: "多個來源的檔案", srcPath: "/data/a.txt", multiple: true, want: "/backup"},
+		{name: "多個來源的目錄", srcPath: "/data/logs", isDir: true, multiple: true, want: "/backup/logs"},
+		{name: "結尾的斜線", srcPath: "/data/logs/", isDir: true, multiple: true, want: "/backup/logs"},
+		{name: "目前的目錄", srcPath: ".", isDir: true, multiple: true, want: filepath.Join("/backup", filepath.Base(dir))},
+		{name: "上層目錄", srcPath: "..", isDir: true, multiple: true, want: filepath.Join("/backup", filepath.Base(filepath.Dir(dir)))},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := targetPath(tt.srcPath, tt.isDir, "/backup", tt.multiple); got != tt.want {
+				t.Errorf("targetPath(%q) = %q, 預期 %q", tt.srcPath, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExpandLocal(t *testing.T) {
+	t.Chdir(t.TempDir())
+	for _, name := range []string{"b.txt", "a.txt", "c.log", "x[1].txt"} {
+		if err := os.WriteFile(name, nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name  string
+		paths []string
+		want  []string
+	}{
+		{name: "萬用字元", paths: []string{"*.txt"}, want: []string{"a.txt", "b.txt", "x[1].txt"}},
+		{name: "多個來源", paths: []string{"c.log", "[ab].txt"}, want: []string{"c.log", "a.txt", "b.txt"}},
+		{name: "檔名有萬用字元", paths: []string{"x[1].txt"}, want: []string{"x[1].txt"}},
+		{name: "不存在的路徑之後再檢查", paths: []string{"missing.txt"}, want: []string{"missing.txt"}},
+		{name: "標準輸入", paths: []string{tp.StdioPath}, want: []string{tp.StdioPath}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var infos []tp.ScpInfo
+			for _, path := range tt.paths {
+				infos = append(infos, tp.ScpInfo{Path: path})
+			}
+			if got := expandLocal(infos); !slices.Equal(got, tt.want) {
+				t.Errorf("expandLocal(%q) = %q, 預期 %q", tt.paths, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,77 @@
+package transport
+
+import (
+	"fmt"
+	"net"
+	"os"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// dialAgent 連線到 SSH_AUTH_SOCK 指定的 ssh-agent.
+// 沒有設定 SSH_AUTH_SOCK 時傳回 nil, 不視為錯誤.
+func dialAgent() (agent.ExtendedAgent, net.Conn, error) {
+	sock := os.Getenv("SSH_AUTH_SOCK")
+	if sock == "" {
+		return nil, nil, nil
+	}
+
+	conn, err := net.Dial("unix", sock)
+	if err != nil {
+		return nil, nil, fmt.Errorf("連線至 ssh-agent (%s): %w", sock, err)
+	}
+
+	return agent.NewClient(conn), conn, nil
+}
+
+// agentSigners 取得 ssh-agent 中所有的身分. 失敗時只顯示警告, 讓認證可以繼續使用其他方式.
+func agentSigners(client agent.ExtendedAgent) []ssh.Signer {
+	if client == nil {
+		return nil
+	}
+
+	signers, err := client.Signers()
+	if err != nil {
+		eprintf("[警告] 無法取得 ssh-agent 的身分: %v\n", err)
+		return nil
+	}
+
+	return signers
+}
+
+// NewSession 在 client 上開啟新的 session. forwardAgent 為 true 時會要求遠端轉送 ssh-agent,
+// 此時 client 必須是以 ConnectOptions.ForwardAgent 建立的連線.
+func NewSession(client *ssh.Client, forwardAgent bool) (*ssh.Session, error) {
+	session, err := client.NewSession()
+	if err != nil {
+		return nil, fmt.Errorf("開啟 SSH session: %w", err)
+	}
+
+	if forwardAgent {
+		if err := agent.RequestAgentForwarding(session); err != nil {
+			session.Close()
+			return nil, fmt.Errorf("要求轉送 ssh-agent: %w", err)
+		}
+	}
+
+	return session, nil
+}
+
+// agentComments 傳回 ssh-agent 中每個公鑰的註解, 以公鑰的 wire 格式為索引
+func agentComments(client agent.ExtendedAgent) map[string]string {
+	comments := make(map[string]string)
+	if client == nil {
+		return comments
+	}
+
+	keys, err := client.List()
+	if err != nil {
+		return comments
+	}
+	for _, key := range keys {
+		comments[string(key.Marshal())] = key.Comment
+	}
+
+	return comments
+}
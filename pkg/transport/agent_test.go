@@ -0,0 +1,115 @@
+package transport
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"net"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// serveAgent 在暫存目錄的 unix socket 上提供含有 keys 的 ssh-agent, 並設定 SSH_AUTH_SOCK
+func serveAgent(t *testing.T, keys map[string]ed25519.PrivateKey) {
+	t.Helper()
+
+	keyring := agent.NewKeyring()
+	for comment, key := range keys {
+		if err := keyring.Add(agent.AddedKey{PrivateKey: key, Comment: comment}); err != nil {
+			t.Fatalf("加入金鑰: %v", err)
+		}
+	}
+
+	sock := filepath.Join(t.TempDir(), "agent.sock")
+	listener, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatalf("建立 socket: %v", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				agent.ServeAgent(keyring, conn)
+			}()
+		}
+	}()
+
+	t.Setenv("SSH_AUTH_SOCK", sock)
+}
+
+func newEd25519Key(t *testing.T) ed25519.PrivateKey {
+	t.Helper()
+
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("產生金鑰: %v", err)
+	}
+
+	return key
+}
+
+func TestAgentSigners(t *testing.T) {
+	tests := []struct {
+		name     string
+		comments []string
+	}{
+		{"沒有身分", nil},
+		{"一個身分", []string{"alice@laptop"}},
+		{"多個身分", []string{"alice@laptop", "deploy"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			keys := make(map[string]ed25519.PrivateKey)
+			want := make(map[string]string)
+			for _, comment := range tt.comments {
+				key := newEd25519Key(t)
+				keys[comment] = key
+				pub, err := ssh.NewPublicKey(key.Public())
+				if err != nil {
+					t.Fatalf("轉換公鑰: %v", err)
+				}
+				want[string(pub.Marshal())] = comment
+			}
+			serveAgent(t, keys)
+
+			client, conn, err := dialAgent()
+			if err != nil {
+				t.Fatalf("dialAgent() 錯誤: %v", err)
+			}
+			defer conn.Close()
+
+			signers := agentSigners(client)
+			if len(signers) != len(want) {
+				t.Fatalf("agentSigners() 有 %d 個身分, 預期 %d 個", len(signers), len(want))
+			}
+			comments := agentComments(client)
+			for _, signer := range signers {
+				key := string(signer.PublicKey().Marshal())
+				if comments[key] != want[key] {
+					t.Errorf("註解 = %q, 預期 %q", comments[key], want[key])
+				}
+			}
+		})
+	}
+}
+
+func TestDialAgentWithoutSocket(t *testing.T) {
+	t.Setenv("SSH_AUTH_SOCK", "")
+
+	client, conn, err := dialAgent()
+	if client != nil || conn != nil || err != nil {
+		t.Errorf("dialAgent() = %v, %v, %v, 預期都是 nil", client, conn, err)
+	}
+	if signers := agentSigners(nil); signers != nil {
+		t.Errorf("agentSigners(nil) = %v, 預期 nil", signers)
+	}
+}
@@ -0,0 +1,124 @@
+package transport
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// applyAlgorithms 依照 opts 中的 Ciphers, KexAlgorithms, MACs 與 HostKeyAlgorithms 設定 config.
+// hostKeyAlgorithms 是沒有指定 HostKeyAlgorithms 時使用的預設清單.
+func applyAlgorithms(config *ssh.ClientConfig, opts ConnectOptions, hostKeyAlgorithms []string) error {
+	var defaults ssh.Config
+	defaults.SetDefaults()
+
+	supported := ssh.SupportedAlgorithms()
+	insecure := ssh.InsecureAlgorithms()
+
+	var err error
+	if config.Ciphers, err = resolveAlgorithms("Ciphers", opts.Ciphers, defaults.Ciphers,
+		slices.Concat(supported.Ciphers, insecure.Ciphers)); err != nil {
+		return err
+	}
+	if config.KeyExchanges, err = resolveAlgorithms("KexAlgorithms", opts.KexAlgorithms, defaults.KeyExchanges,
+		slices.Concat(supported.KeyExchanges, insecure.KeyExchanges, defaults.KeyExchanges)); err != nil {
+		return err
+	}
+	if config.MACs, err = resolveAlgorithms("MACs", opts.MACs, defaults.MACs,
+		slices.Concat(supported.MACs, insecure.MACs)); err != nil {
+		return err
+	}
+	if config.HostKeyAlgorithms, err = resolveAlgorithms("HostKeyAlgorithms", opts.HostKeyAlgorithms, hostKeyAlgorithms,
+		slices.Concat(supported.HostKeys, insecure.HostKeys)); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// resolveAlgorithms 依照 OpenSSH 的規則解析以逗號分隔的演算法清單:
+// "+a,b" 加在預設清單之後, "-a,b" 從預設清單移除 (可用萬用字元), "^a,b" 放在預設清單之前, 其他則取代預設清單.
+// spec 為空字串時傳回預設清單.
+func resolveAlgorithms(keyword string, spec string, defaults []string, known []string) ([]string, error) {
+	if spec == "" {
+		return defaults, nil
+	}
+
+	var modifier byte
+	if strings.ContainsRune("+-^", rune(spec[0])) {
+		modifier, spec = spec[0], spec[1:]
+	}
+
+	var names []string
+	for _, name := range strings.Split(spec, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+
+	// - 的名稱可以使用萬用字元, 其他的必須是支援的演算法
+	if modifier != '-' {
+		for _, name := range names {
+			if !slices.Contains(known, name) {
+				return nil, fmt.Errorf("%s: 不支援的演算法 %s", keyword, name)
+			}
+		}
+	}
+
+	var algos []string
+	switch modifier {
+	case '-':
+		algos = slices.DeleteFunc(slices.Clone(defaults), func(algo string) bool {
+			return slices.ContainsFunc(names, func(pattern string) bool {
+				return matchWildcard(pattern, algo)
+			})
+		})
+	case '+':
+		algos = slices.Clone(defaults)
+		for _, name := range names {
+			if !slices.Contains(algos, name) {
+				algos = append(algos, name)
+			}
+		}
+	case '^':
+		algos = slices.Clone(names)
+		for _, algo := range defaults {
+			if !slices.Contains(algos, algo) {
+				algos = append(algos, algo)
+			}
+		}
+	default:
+		algos = names
+	}
+
+	if len(algos) == 0 {
+		return nil, fmt.Errorf("%s: 沒有可用的演算法", keyword)
+	}
+
+	return algos, nil
+}
+
+// printAlgorithms 顯示與伺服器協商的演算法
+func printAlgorithms(client *ssh.Client) {
+	conn, ok := client.Conn.(ssh.AlgorithmsConnMetadata)
+	if !ok {
+		return
+	}
+
+	algos := conn.Algorithms()
+	eprintf("金鑰交換: %s\n", algos.KeyExchange)
+	eprintf("主機金鑰: %s\n", algos.HostKey)
+	eprintf("加密 (送出/接收): %s / %s\n", algos.Write.Cipher, algos.Read.Cipher)
+	eprintf("MAC (送出/接收): %s / %s\n", macName(algos.Write), macName(algos.Read))
+}
+
+// macName 傳回 MAC 的名稱. AEAD 加密 (如 aes128-gcm) 不使用另外的 MAC.
+func macName(algos ssh.DirectionAlgorithms) string {
+	if algos.MAC == "" {
+		return "(" + algos.Cipher + " 內建)"
+	}
+
+	return algos.MAC
+}
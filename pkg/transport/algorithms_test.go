@@ -0,0 +1,50 @@
+package transport
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestResolveAlgorithms(t *testing.T) {
+	defaults := []string{"aes128-gcm@openssh.com", "aes256-gcm@openssh.com", "aes128-ctr"}
+	known := append(slices.Clone(defaults), "aes256-ctr", "3des-cbc")
+
+	tests := []struct {
+		spec    string
+		want    []string
+		wantErr bool
+	}{
+		{spec: "", want: defaults},
+		{spec: "aes256-ctr,aes128-ctr", want: []string{"aes256-ctr", "aes128-ctr"}},
+		{spec: " aes256-ctr , ", want: []string{"aes256-ctr"}},
+		{spec: "+3des-cbc", want: []string{"aes128-gcm@openssh.com", "aes256-gcm@openssh.com", "aes128-ctr", "3des-cbc"}},
+		{spec: "+aes128-ctr", want: defaults},
+		{spec: "^aes128-ctr,aes256-ctr", want: []string{"aes128-ctr", "aes256-ctr", "aes128-gcm@openssh.com", "aes256-gcm@openssh.com"}},
+		{spec: "-aes128-ctr", want: []string{"aes128-gcm@openssh.com", "aes256-gcm@openssh.com"}},
+		{spec: "-*-gcm@openssh.com", want: []string{"aes128-ctr"}},
+		{spec: "-unknown-cipher", want: defaults},
+		{spec: "-*", wantErr: true},
+		{spec: "-", want: defaults},
+		{spec: ",", wantErr: true},
+		{spec: "chacha20-poly1305", wantErr: true},
+		{spec: "+aes256-ctr,none", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.spec, func(t *testing.T) {
+			got, err := resolveAlgorithms("Ciphers", tt.spec, defaults, known)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("resolveAlgorithms(%q) = %v, 預期錯誤", tt.spec, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("resolveAlgorithms(%q) 錯誤: %v", tt.spec, err)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("resolveAlgorithms(%q) = %v, 預期 %v", tt.spec, got, tt.want)
+			}
+		})
+	}
+}
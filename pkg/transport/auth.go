@@ -0,0 +1,146 @@
+package transport
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// 密碼與 keyboard-interactive 認證失敗時最多重試的次數, 與 OpenSSH 的 NumberOfPasswordPrompts 相同
+const maxAuthTries = 3
+
+// 以密碼與 keyboard-interactive 認證成功時顯示的身分
+const (
+	passwordIdentity            = "密碼"
+	keyboardInteractiveIdentity = "keyboard-interactive"
+)
+
+// passwords 記錄這次執行中登入成功的密碼, 以 user@host:port 為索引. 重新連線時直接使用, 不必再詢問.
+var passwords struct {
+	sync.Mutex
+	m map[string]string
+}
+
+// cachedPassword 傳回登入 addr 成功過的密碼, 沒有時傳回 nil
+func cachedPassword(username string, addr string) *string {
+	passwords.Lock()
+	defer passwords.Unlock()
+
+	if password, ok := passwords.m[username+"@"+addr]; ok {
+		return &password
+	}
+
+	return nil
+}
+
+// cachePassword 記錄登入 addr 成功的密碼
+func cachePassword(username string, addr string, password string) {
+	passwords.Lock()
+	defer passwords.Unlock()
+
+	if passwords.m == nil {
+		passwords.m = make(map[string]string)
+	}
+	passwords.m[username+"@"+addr] = password
+}
+
+// interactiveAuthMethods 傳回需要使用者輸入的認證方式: keyboard-interactive 與密碼.
+// 伺服器要求多重認證 (如 publickey,keyboard-interactive) 時, ssh 套件會在部分成功後繼續嘗試這些方式.
+// password 不為空時, 兩種方式都先使用這個密碼, 而且錯誤時不再詢問.
+func interactiveAuthMethods(username string, host string, tracker *identityTracker, password *string) []ssh.AuthMethod {
+	var kbdSecret, passwordSecret *staticSecret
+	if password != nil {
+		kbdSecret = &staticSecret{value: *password}
+		passwordSecret = &staticSecret{value: *password}
+	}
+
+	return []ssh.AuthMethod{
+		ssh.RetryableAuthMethod(ssh.KeyboardInteractive(keyboardInteractiveChallenge(username, host, tracker, kbdSecret)), maxAuthTries),
+		ssh.RetryableAuthMethod(ssh.PasswordCallback(passwordPrompt(username, host, tracker, passwordSecret)), maxAuthTries),
+	}
+}
+
+// keyboardInteractiveChallenge 顯示伺服器送來的提示 (如 OTP, PAM 的問題), 依照 echo 決定是否顯示輸入.
+// 有密碼來源時, 詢問密碼的不回顯問題以密碼來源回答, 其他的問題 (如驗證碼) 仍然詢問使用者.
+func keyboardInteractiveChallenge(username string, host string, tracker *identityTracker, password *staticSecret) ssh.KeyboardInteractiveChallenge {
+	return func(name, instruction string, questions []string, echos []bool) ([]string, error) {
+		tracker.last = keyboardInteractiveIdentity
+
+		answers := make([]string, len(questions))
+		prompted := false
+		for idx, question := range questions {
+			isPassword := !echos[idx] && isPasswordPrompt(question)
+			if isPassword && password != nil {
+				value, ok := password.next()
+				if !ok {
+					return nil, fmt.Errorf("密碼來源提供的密碼錯誤")
+				}
+				answers[idx] = value
+				continue
+			}
+
+			if !prompted {
+				if name != "" {
+					eprintf("%s\n", name)
+				}
+				if instruction != "" {
+					eprintf("%s\n", instruction)
+				}
+				prompted = true
+			}
+
+			if question == "" {
+				question = fmt.Sprintf("%s@%s 的回應: ", username, host)
+			}
+
+			var err error
+			if echos[idx] {
+				answers[idx], err = readLine(question)
+			} else {
+				answers[idx], err = readPassword(question)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("讀取回應: %w", err)
+			}
+			if isPassword {
+				tracker.password = answers[idx]
+			}
+		}
+
+		return answers, nil
+	}
+}
+
+// isPasswordPrompt 判斷 keyboard-interactive 的問題是否在詢問登入密碼, 而不是一次性密碼或驗證碼
+func isPasswordPrompt(question string) bool {
+	question = strings.ToLower(question)
+	if strings.Contains(question, "one-time") || strings.Contains(question, "otp") {
+		return false
+	}
+
+	return strings.Contains(question, "password") || strings.Contains(question, "passwd") || strings.Contains(question, "密碼")
+}
+
+// passwordPrompt 從密碼來源或終端機讀取密碼
+func passwordPrompt(username string, host string, tracker *identityTracker, password *staticSecret) func() (string, error) {
+	return func() (string, error) {
+		tracker.last = passwordIdentity
+
+		if password != nil {
+			if value, ok := password.next(); ok {
+				return value, nil
+			}
+			return "", fmt.Errorf("密碼來源提供的密碼錯誤")
+		}
+
+		password, err := readPassword(fmt.Sprintf("%s@%s 的密碼: ", username, host))
+		if err != nil {
+			return "", fmt.Errorf("讀取密碼: %w", err)
+		}
+		tracker.password = password
+
+		return password, nil
+	}
+}
@@ -0,0 +1,207 @@
+package transport
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// loadCertificate 讀取 OpenSSH 使用者憑證 (如 id_ed25519-cert.pub)
+func loadCertificate(file string) (*ssh.Certificate, error) {
+	buf, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	pub, _, _, _, err := ssh.ParseAuthorizedKey(buf)
+	if err != nil {
+		return nil, fmt.Errorf("解析憑證 %s: %w", file, err)
+	}
+
+	cert, ok := pub.(*ssh.Certificate)
+	if !ok {
+		return nil, fmt.Errorf("%s 不是憑證", file)
+	}
+	if cert.CertType != ssh.UserCert {
+		return nil, fmt.Errorf("%s 不是使用者憑證", file)
+	}
+
+	now := uint64(time.Now().Unix())
+	if now < cert.ValidAfter || (cert.ValidBefore != ssh.CertTimeInfinity && now >= cert.ValidBefore) {
+		return nil, fmt.Errorf("憑證 %s 不在有效期間內", file)
+	}
+
+	return cert, nil
+}
+
+// loadCertificates 讀取所有存在的憑證檔, 無法使用的憑證只顯示警告
+func loadCertificates(files []string) []*ssh.Certificate {
+	var certs []*ssh.Certificate
+	for _, file := range files {
+		path, err := expandPath(file)
+		if err != nil {
+			continue
+		}
+		if _, err := os.Stat(path); err != nil {
+			continue
+		}
+
+		cert, err := loadCertificate(path)
+		if err != nil {
+			eprintf("[警告] %v\n", err)
+			continue
+		}
+		certs = append(certs, cert)
+	}
+
+	return certs
+}
+
+// withCertificates 對每一個 signer, 若有對應的憑證則在它前面加上憑證版本的 signer.
+// 伺服器只接受憑證時先試憑證, 不接受時還能退回一般的公鑰.
+func withCertificates(signers []ssh.Signer, certs []*ssh.Certificate) []ssh.Signer {
+	var result []ssh.Signer
+	for _, signer := range signers {
+		// ssh-agent 中可能已經有憑證, 不必再包裝
+		if _, isCert := signer.PublicKey().(*ssh.Certificate); !isCert {
+			for _, cert := range certs {
+				if !bytes.Equal(cert.Key.Marshal(), signer.PublicKey().Marshal()) {
+					continue
+				}
+
+				certSigner, err := ssh.NewCertSigner(cert, signer)
+				if err != nil {
+					eprintf("[警告] 無法使用憑證 %s: %v\n", cert.KeyId, err)
+					continue
+				}
+				result = append(result, certSigner)
+			}
+		}
+		result = append(result, signer)
+	}
+
+	return result
+}
+
+// certificateFiles 傳回私鑰旁邊可能存在的憑證檔 (私鑰檔名加上 -cert.pub)
+func certificateFiles(keys []string) []string {
+	var files []string
+	for _, key := range keys {
+		if key == "" {
+			continue
+		}
+
+		path, err := expandPath(key + "-cert.pub")
+		if err != nil || slices.Contains(files, path) {
+			continue
+		}
+		files = append(files, path)
+	}
+
+	return files
+}
+
+// hasHostAuthority 判斷 known_hosts 中是否有適用於 hostname 的 @cert-authority.
+// 有的話才優先要求伺服器出示主機憑證, 否則伺服器的憑證無法驗證.
+func hasHostAuthority(files []string, hostname string) bool {
+	host, port, err := splitHostPortDefault(hostname)
+	if err != nil {
+		return false
+	}
+
+	candidates := []string{knownhosts.Normalize(hostname)}
+	if port == "22" {
+		candidates = append(candidates, host)
+	}
+
+	for _, file := range files {
+		f, err := os.Open(file)
+		if err != nil {
+			continue
+		}
+
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+			if len(fields) < 3 || fields[0] != "@cert-authority" {
+				continue
+			}
+
+			if matchKnownHostsPatterns(fields[1], candidates) {
+				f.Close()
+				return true
+			}
+		}
+		f.Close()
+	}
+
+	return false
+}
+
+// matchKnownHostsPatterns 比對 known_hosts 中以逗號分隔的主機模式, 支援萬用字元, ! 與雜湊過的名稱
+func matchKnownHostsPatterns(patterns string, candidates []string) bool {
+	matched := false
+	for _, pattern := range strings.Split(patterns, ",") {
+		negated := strings.HasPrefix(pattern, "!")
+		pattern = strings.TrimPrefix(pattern, "!")
+
+		for _, candidate := range candidates {
+			if !matchKnownHostsPattern(pattern, candidate) {
+				continue
+			}
+			if negated {
+				return false
+			}
+			matched = true
+		}
+	}
+
+	return matched
+}
+
+func matchKnownHostsPattern(pattern string, candidate string) bool {
+	if strings.HasPrefix(pattern, "|1|") {
+		parts := strings.Split(pattern[3:], "|")
+		if len(parts) != 2 {
+			return false
+		}
+		salt, err := base64.StdEncoding.DecodeString(parts[0])
+		if err != nil {
+			return false
+		}
+		hash, err := base64.StdEncoding.DecodeString(parts[1])
+		if err != nil {
+			return false
+		}
+
+		mac := hmac.New(sha1.New, salt)
+		mac.Write([]byte(candidate))
+		return hmac.Equal(mac.Sum(nil), hash)
+	}
+
+	return matchWildcard(pattern, candidate)
+}
+
+// splitHostPortDefault 拆開 host:port, 沒有埠號時視為 22
+func splitHostPortDefault(addr string) (string, string, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		if strings.Contains(err.Error(), "missing port") {
+			return strings.Trim(addr, "[]"), "22", nil
+		}
+		return "", "", err
+	}
+
+	return host, port, nil
+}
@@ -0,0 +1,160 @@
+package transport
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// SFTP 的封包類型與狀態碼 (draft-ietf-secsh-filexfer-02)
+const (
+	sftpPacketInit          = 1
+	sftpPacketVersion       = 2
+	sftpPacketStatus        = 101
+	sftpPacketExtended      = 200
+	sftpPacketExtendedReply = 201
+
+	sftpStatusOpUnsupported = 8
+)
+
+// 封包大小的上限, 避免讀到不正確的長度時配置過多記憶體
+const maxSFTPPacketSize = 256 << 10
+
+// errCheckFileUnsupported 表示伺服器不支援 check-file 或不支援以 SHA-256 計算
+var errCheckFileUnsupported = errors.New("伺服器不支援以 check-file 計算 SHA-256")
+
+// remoteCheckFile 以 SFTP 的 check-file 擴充功能 (draft-ietf-secsh-filexfer-extensions) 請伺服器計算 remotePath 的 SHA-256.
+// pkg/sftp 無法送出任意的擴充請求, 所以另外開啟一個 sftp 子系統直接送出封包.
+func remoteCheckFile(remote *Remote, remotePath string) ([]byte, error) {
+	if _, ok := remote.Client().HasExtension("check-file"); !ok {
+		return nil, errCheckFileUnsupported
+	}
+
+	session, err := NewSession(remote.sshClient(), false)
+	if err != nil {
+		return nil, err
+	}
+	defer session.Close()
+
+	w, err := session.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	r, err := session.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := session.RequestSubsystem("sftp"); err != nil {
+		return nil, fmt.Errorf("開啟 sftp 子系統: %w", err)
+	}
+
+	return checkFile(r, w, remotePath)
+}
+
+// checkFile 經由 SFTP 連線 (讀取 r, 寫入 w) 初始化後送出 check-file-name 請求, 傳回整個檔案 path 的 SHA-256
+func checkFile(r io.Reader, w io.Writer, path string) ([]byte, error) {
+	if err := writeSFTPPacket(w, sftpPacketInit, binary.BigEndian.AppendUint32(nil, 3)); err != nil {
+		return nil, err
+	}
+	if typ, _, err := readSFTPPacket(r); err != nil {
+		return nil, err
+	} else if typ != sftpPacketVersion {
+		return nil, fmt.Errorf("SFTP 初始化的回應不正確 (類型 %d)", typ)
+	}
+
+	const requestID = 1
+	req := binary.BigEndian.AppendUint32(nil, requestID)
+	req = appendSFTPString(req, "check-file-name")
+	req = appendSFTPString(req, path)
+	req = appendSFTPString(req, "sha256")
+	req = binary.BigEndian.AppendUint64(req, 0) // 從檔案開頭
+	req = binary.BigEndian.AppendUint64(req, 0) // 到檔案結尾
+	req = binary.BigEndian.AppendUint32(req, 0) // 整個檔案只計算一個檢查碼
+	if err := writeSFTPPacket(w, sftpPacketExtended, req); err != nil {
+		return nil, err
+	}
+
+	typ, data, err := readSFTPPacket(r)
+	if err != nil {
+		return nil, err
+	}
+
+	buf := bytes.NewBuffer(data)
+	var id uint32
+	if err := binary.Read(buf, binary.BigEndian, &id); err != nil || id != requestID {
+		return nil, fmt.Errorf("check-file 的回應不正確")
+	}
+
+	switch typ {
+	case sftpPacketStatus:
+		var code uint32
+		if err := binary.Read(buf, binary.BigEndian, &code); err != nil {
+			return nil, fmt.Errorf("check-file 的回應不正確")
+		}
+		if code == sftpStatusOpUnsupported {
+			return nil, errCheckFileUnsupported
+		}
+		msg, _ := readSFTPString(buf)
+		return nil, fmt.Errorf("check-file 失敗: %s (狀態 %d)", msg, code)
+	case sftpPacketExtendedReply:
+		if name, err := readSFTPString(buf); err != nil || name != "check-file" {
+			return nil, fmt.Errorf("check-file 的回應不正確")
+		}
+		if algo, err := readSFTPString(buf); err != nil || algo != "sha256" {
+			return nil, errCheckFileUnsupported
+		}
+		if buf.Len() != 32 {
+			return nil, fmt.Errorf("check-file 傳回的檢查碼長度不正確 (%d)", buf.Len())
+		}
+		return buf.Bytes(), nil
+	default:
+		return nil, fmt.Errorf("check-file 的回應不正確 (類型 %d)", typ)
+	}
+}
+
+// writeSFTPPacket 寫出一個 SFTP 封包: 長度, 類型與內容
+func writeSFTPPacket(w io.Writer, typ byte, payload []byte) error {
+	packet := binary.BigEndian.AppendUint32(nil, uint32(len(payload)+1))
+	packet = append(packet, typ)
+	packet = append(packet, payload...)
+
+	_, err := w.Write(packet)
+	return err
+}
+
+// readSFTPPacket 讀取一個 SFTP 封包, 傳回類型與內容
+func readSFTPPacket(r io.Reader) (byte, []byte, error) {
+	var length uint32
+	if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+		return 0, nil, fmt.Errorf("讀取 SFTP 封包: %w", err)
+	}
+	if length == 0 || length > maxSFTPPacketSize {
+		return 0, nil, fmt.Errorf("SFTP 封包的長度不正確 (%d)", length)
+	}
+
+	packet := make([]byte, length)
+	if _, err := io.ReadFull(r, packet); err != nil {
+		return 0, nil, fmt.Errorf("讀取 SFTP 封包: %w", err)
+	}
+
+	return packet[0], packet[1:], nil
+}
+
+func appendSFTPString(b []byte, s string) []byte {
+	b = binary.BigEndian.AppendUint32(b, uint32(len(s)))
+	return append(b, s...)
+}
+
+func readSFTPString(buf *bytes.Buffer) (string, error) {
+	var length uint32
+	if err := binary.Read(buf, binary.BigEndian, &length); err != nil {
+		return "", err
+	}
+	if int(length) > buf.Len() {
+		return "", io.ErrUnexpectedEOF
+	}
+
+	return string(buf.Next(int(length))), nil
+}
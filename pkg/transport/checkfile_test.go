@@ -0,0 +1,135 @@
+package transport
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+	"testing"
+)
+
+// fakeCheckFileServer 模擬 SFTP 伺服器: 回應初始化, 讀取 check-file-name 請求後送出 reply
+func fakeCheckFileServer(t *testing.T, r io.Reader, w io.Writer, wantPath string, reply func(id uint32) (byte, []byte)) {
+	t.Helper()
+
+	if typ, _, err := readSFTPPacket(r); err != nil || typ != sftpPacketInit {
+		t.Errorf("初始化封包: 類型 %d, %v", typ, err)
+		return
+	}
+	writeSFTPPacket(w, sftpPacketVersion, binary.BigEndian.AppendUint32(nil, 3))
+
+	typ, data, err := readSFTPPacket(r)
+	if err != nil || typ != sftpPacketExtended {
+		t.Errorf("擴充請求: 類型 %d, %v", typ, err)
+		return
+	}
+	buf := bytes.NewBuffer(data)
+	var id uint32
+	binary.Read(buf, binary.BigEndian, &id)
+	for _, want := range []string{"check-file-name", wantPath, "sha256"} {
+		if got, err := readSFTPString(buf); err != nil || got != want {
+			t.Errorf("請求欄位 = %q, %v, 預期 %q", got, err, want)
+		}
+	}
+
+	typ, payload := reply(id)
+	writeSFTPPacket(w, typ, payload)
+}
+
+func TestCheckFile(t *testing.T) {
+	sum := sha256.Sum256([]byte("scopy"))
+
+	tests := []struct {
+		name    string
+		reply   func(id uint32) (byte, []byte)
+		want    []byte
+		wantErr error
+	}{
+		{
+			name: "sha256",
+			reply: func(id uint32) (byte, []byte) {
+				b := binary.BigEndian.AppendUint32(nil, id)
+				b = appendSFTPString(b, "check-file")
+				b = appendSFTPString(b, "sha256")
+				return sftpPacketExtendedReply, append(b, sum[:]...)
+			},
+			want: sum[:],
+		},
+		{
+			name: "不支援",
+			reply: func(id uint32) (byte, []byte) {
+				b := binary.BigEndian.AppendUint32(nil, id)
+				b = binary.BigEndian.AppendUint32(b, sftpStatusOpUnsupported)
+				return sftpPacketStatus, appendSFTPString(b, "unsupported")
+			},
+			wantErr: errCheckFileUnsupported,
+		},
+		{
+			name: "其他演算法",
+			reply: func(id uint32) (byte, []byte) {
+				b := binary.BigEndian.AppendUint32(nil, id)
+				b = appendSFTPString(b, "check-file")
+				b = appendSFTPString(b, "md5")
+				return sftpPacketExtendedReply, append(b, make([]byte, 16)...)
+			},
+			wantErr: errCheckFileUnsupported,
+		},
+		{
+			name: "檔案不存在",
+			reply: func(id uint32) (byte, []byte) {
+				b := binary.BigEndian.AppendUint32(nil, id)
+				b = binary.BigEndian.AppendUint32(b, 2)
+				return sftpPacketStatus, appendSFTPString(b, "no such file")
+			},
+			wantErr: errors.New("check-file 失敗"),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clientR, serverW := io.Pipe()
+			serverR, clientW := io.Pipe()
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				fakeCheckFileServer(t, serverR, serverW, "/data/file", tt.reply)
+			}()
+
+			got, err := checkFile(clientR, clientW, "/data/file")
+			<-done
+
+			switch {
+			case tt.wantErr == nil && err != nil:
+				t.Fatalf("checkFile() 錯誤: %v", err)
+			case tt.wantErr != nil && err == nil:
+				t.Fatalf("checkFile() 沒有錯誤, 預期 %v", tt.wantErr)
+			case errors.Is(tt.wantErr, errCheckFileUnsupported) && !errors.Is(err, errCheckFileUnsupported):
+				t.Fatalf("checkFile() 錯誤 = %v, 預期 %v", err, tt.wantErr)
+			}
+			if !bytes.Equal(got, tt.want) {
+				t.Errorf("checkFile() = %x, 預期 %x", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSha256sumUnavailable(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"輸出格式", errBadSha256sumOutput, true},
+		{"連線中斷", io.EOF, false},
+		{"其他錯誤", errors.New("ssh: unexpected packet"), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := sha256sumUnavailable(tt.err); got != tt.want {
+				t.Errorf("sha256sumUnavailable(%v) = %v, 預期 %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,177 @@
+package transport
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/pkg/sftp"
+)
+
+// 複製分段時每次 ReadAt/WriteAt 的大小. 比 SFTP 的封包大, 讓 sftp 套件一次送出多個請求.
+const chunkBufferSize = 1 << 20
+
+// chunk 是大檔案中的一段, done 記錄已經複製的位元組數, 重新連線後從這裡繼續
+type chunk struct {
+	offset int64
+	length int64
+	done   int64
+}
+
+// splitChunks 將 size 位元組的檔案切成每段 chunkSize 的分段, from 之前的部分已經複製過
+func splitChunks(size int64, chunkSize int64, from int64) []*chunk {
+	var chunks []*chunk
+	for offset := int64(0); offset < size; offset += chunkSize {
+		length := min(chunkSize, size-offset)
+		done := min(max(from-offset, 0), length)
+		chunks = append(chunks, &chunk{offset: offset, length: length, done: done})
+	}
+
+	return chunks
+}
+
+// completedPrefix 傳回從檔案開頭起連續完成的位元組數. 分段不是依序完成的, 中斷時只有這個長度以內的內容可以信任.
+func completedPrefix(chunks []*chunk) int64 {
+	var prefix int64
+	for _, c := range chunks {
+		prefix += c.done
+		if c.done < c.length {
+			break
+		}
+	}
+
+	return prefix
+}
+
+// useChunks 判斷大小為 size 的檔案是否要分段同時傳輸
+func useChunks(size int64, opts TransferOptions) bool {
+	return opts.Streams > 1 && opts.ChunkSize > 0 && size > opts.ChunkSize
+}
+
+// transferChunks 以 opts.Streams 個分段同時傳輸 chunks. 分段依序分配到 remote 的各條連線上,
+// copy 以該連線的 SFTP 客戶端複製一個分段, 連線中斷時重新連線, 從分段中斷的地方繼續. 完成的分段記錄在 journal.
+func transferChunks(remote *Remote, chunks []*chunk, journal *chunkJournal, opts TransferOptions, copy func(client *sftp.Client, c *chunk) error) error {
+	pool := newWorkerPool(opts.Streams)
+	for idx, c := range chunks {
+		if c.done == c.length {
+			continue
+		}
+
+		conn := remote.stream(idx)
+		submitted := pool.submit(func() error {
+			if err := conn.retry(func(client *sftp.Client) error {
+				return copy(client, c)
+			}); err != nil {
+				return err
+			}
+
+			journal.done(idx)
+			return nil
+		})
+		if !submitted {
+			break
+		}
+	}
+
+	return pool.wait(nil)
+}
+
+// copyChunk 以 ReadAt/WriteAt 複製分段中還沒完成的部分
+func copyChunk(dst io.WriterAt, src io.ReaderAt, c *chunk) error {
+	buf := make([]byte, min(chunkBufferSize, c.length))
+	for c.done < c.length {
+		offset := c.offset + c.done
+		n, err := src.ReadAt(buf[:min(int64(len(buf)), c.length-c.done)], offset)
+		if n > 0 {
+			if _, err := dst.WriteAt(buf[:n], offset); err != nil {
+				return err
+			}
+			c.done += int64(n)
+		}
+
+		if err == io.EOF && c.done < c.length {
+			return fmt.Errorf("檔案在傳輸中變短: %w", io.ErrUnexpectedEOF)
+		} else if err != nil && err != io.EOF {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// downloadChunks 分段同時下載遠端檔案到 localFile, from 之前的部分已經下載過. 傳輸中以 journalPath 記錄連續完成的部分,
+// 失敗時將本地檔案截短到連續完成的部分, 讓續傳時可以從那裡繼續.
+func downloadChunks(remote *Remote, remotePath string, localFile *os.File, journalPath string, size int64, from int64, opts TransferOptions, fp *fileProgress) error {
+	chunks := splitChunks(size, opts.ChunkSize, from)
+	journal, err := newChunkJournal(chunks, from, func(prefix int64) error {
+		return writeLocalJournal(journalPath, prefix)
+	})
+	if err != nil {
+		return fmt.Errorf("建立分段記錄檔: %w", err)
+	}
+
+	err = transferChunks(remote, chunks, journal, opts, func(client *sftp.Client, c *chunk) error {
+		remoteFile, err := client.Open(remotePath)
+		if err != nil {
+			return fmt.Errorf("開啟遠端檔案: %w", err)
+		}
+		defer remoteFile.Close()
+
+		if err := copyChunk(opts.limiter.writerAt(fp.writerAt(localFile)), remoteFile, c); err != nil {
+			return fmt.Errorf("複製檔案: %w", err)
+		}
+
+		return nil
+	})
+	if err != nil {
+		localFile.Truncate(completedPrefix(chunks))
+		return err
+	}
+	os.Remove(journalPath)
+
+	return nil
+}
+
+// uploadChunks 分段同時上傳 localFile 到已經建立的遠端檔案, from 之前的部分已經上傳過. 傳輸中以 journalPath 記錄連續完成的部分,
+// 失敗時將遠端檔案截短到連續完成的部分, 讓續傳時可以從那裡繼續; 無法截短時刪除遠端檔案.
+func uploadChunks(remote *Remote, remotePath string, localFile *os.File, journalPath string, size int64, from int64, opts TransferOptions, fp *fileProgress) error {
+	chunks := splitChunks(size, opts.ChunkSize, from)
+	journal, err := newChunkJournal(chunks, from, func(prefix int64) error {
+		return writeRemoteJournal(remote, journalPath, prefix)
+	})
+	if err != nil {
+		return fmt.Errorf("建立遠端的分段記錄檔: %w", err)
+	}
+
+	err = transferChunks(remote, chunks, journal, opts, func(client *sftp.Client, c *chunk) error {
+		remoteFile, err := client.OpenFile(remotePath, os.O_WRONLY)
+		if err != nil {
+			return fmt.Errorf("開啟遠端檔案 (%s): %w", remotePath, err)
+		}
+		defer remoteFile.Close()
+
+		if err := copyChunk(opts.limiter.writerAt(fp.writerAt(remoteFile)), localFile, c); err != nil {
+			return fmt.Errorf("複製檔案至遠端: %w", err)
+		}
+
+		return nil
+	})
+	if err != nil {
+		// 沒有截短的遠端檔案中間可能有還沒寫入的部分. 截短與刪除都失敗時 (連線無法恢復), 續傳以記錄檔為準
+		prefix := completedPrefix(chunks)
+		if truncErr := remote.retry(func(client *sftp.Client) error {
+			return client.Truncate(remotePath, prefix)
+		}); truncErr != nil {
+			eprintf("[警告] 無法截短遠端檔案 %s, 刪除它: %v\n", remotePath, truncErr)
+			remote.retry(func(client *sftp.Client) error {
+				return client.Remove(remotePath)
+			})
+		}
+		return err
+	}
+	remote.retry(func(client *sftp.Client) error {
+		return client.Remove(journalPath)
+	})
+
+	return nil
+}
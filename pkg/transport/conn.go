@@ -1,17 +1,26 @@
 package transport
 
 import (
+	"cmp"
 	"fmt"
 	"net"
 	"os"
+	"os/user"
 	"path/filepath"
-	"runtime"
+	"slices"
 	"strconv"
 	"strings"
-	"syscall"
+	"sync/atomic"
+	"time"
 
 	"golang.org/x/crypto/ssh"
-	"golang.org/x/term"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+const (
+	defaultConnectTimeout      = 30 * time.Second
+	defaultServerAliveInterval = 30 * time.Second
+	defaultServerAliveCountMax = 3
 )
 
 var defaultPrivateKeys = []string{
@@ -21,141 +30,425 @@ var defaultPrivateKeys = []string{
 	"~/.ssh/id_ecdsa",
 }
 
+// ConnectOptions 建立 SSH 連線時使用的設定
+type ConnectOptions struct {
+	Port                  uint16   // SSH 埠號, 0 表示使用 22
+	Username              string   // 登入的使用者名稱
+	Keys                  []string // 依序嘗試的私鑰檔案, 沒有指定時嘗試所有預設的私鑰
+	ForcePassword         bool     // 不使用私鑰, 直接以密碼認證
+	PasswordFile          string   // 從這個檔案的第一行讀取登入密碼, 不詢問使用者
+	PasswordEnv           string   // 從這個環境變數讀取登入密碼, 不詢問使用者
+	PassphraseFile        string   // 從這個檔案的第一行讀取私鑰密碼
+	PassphraseEnv         string   // 從這個環境變數讀取私鑰密碼
+	StrictHostKeyChecking string   // 主機金鑰檢查模式, 見 HostKeyCheckAsk 等常數
+	NoAgent               bool     // 不使用 ssh-agent 的身分
+	ForwardAgent          bool     // 允許遠端使用本地的 ssh-agent, 只有以 NewSession(client, true) 開啟的 session 會要求轉送
+	CertificateFiles      []string // 額外的使用者憑證檔, 私鑰旁邊的 -cert.pub 不必列出
+	ProxyJump             string   // 以逗號分隔的跳板主機 [user@]host[:port], "none" 表示不使用跳板
+	ProxyCommand          string   // 以這個指令的 stdin/stdout 作為連線, "none" 表示不使用
+	Proxy                 string   // 代理伺服器網址, 如 socks5://host:1080 或 http://host:3128
+	Dialer                Dialer   // 建立 TCP 連線的方式, 設定時 ProxyCommand 與 Proxy 不會使用
+	Verbose               bool     // 顯示協商的演算法等連線細節
+
+	// 以逗號分隔的演算法清單, 規則與 OpenSSH 相同: 以 + 開頭加在預設清單之後, - 開頭從預設清單移除, ^ 開頭放在預設清單之前
+	Ciphers           string
+	KexAlgorithms     string
+	MACs              string
+	HostKeyAlgorithms string
+
+	ConnectTimeout      time.Duration // 建立連線與交握的時限, 0 表示依照 ssh 設定檔或預設的 30 秒
+	ServerAliveInterval time.Duration // 送出 keepalive 的間隔, 0 表示依照 ssh 設定檔或預設的 30 秒
+	ServerAliveCountMax int           // 連續幾次 keepalive 沒有回應就中斷連線, 0 表示依照 ssh 設定檔或預設的 3 次
+	Reconnects          int           // Dial 建立的連線中斷時, 最多連續重新連線的次數
+}
+
 // Connect 函數用於建立 SSH 連線
-// 它會嘗試使用 PrivateKey 進行認證, 如果失敗或未指定, 則嘗試使用密碼認證.
-func Connect(host string, port uint16, username string, key string, forcePassword bool) (*ssh.Client, error) {
-	portStr := "22"
-	if port > 0 {
-		portStr = strconv.FormatUint(uint64(port), 10)
+// host 可以是 ~/.ssh/config 中的 Host 別名, opts 中沒有指定的設定會由 ssh 設定檔補上.
+// 它會先嘗試 ssh-agent 中的身分, 再嘗試使用 PrivateKey 進行認證, 如果失敗或未指定, 則嘗試 keyboard-interactive 與密碼認證.
+// 設定了 ProxyJump 時會依序經由每一台跳板主機連線, 每一台跳板都使用相同的認證方式.
+func Connect(host string, opts ConnectOptions) (*ssh.Client, error) {
+	jumpOpts := opts
+
+	host, opts, err := applyHostConfig(host, opts)
+	if err != nil {
+		return nil, err
 	}
-	addr := net.JoinHostPort(host, portStr)
 
-	if forcePassword {
-		key = ""
-	} else if key == "" {
-		key = findDefaultKey()
+	var via *ssh.Client
+	if opts.ProxyJump != "" && opts.ProxyJump != "none" {
+		via, err = connectJumpHosts(opts.ProxyJump, jumpOpts)
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	// 準備身份驗證方法
-	var authMethods []ssh.AuthMethod
-	if key != "" {
-		// 嘗試使用公鑰認證 (如果 PrivateKey 欄位非空)
-		keyPath, err := expandPath(key)
-		if err == nil {
-			signer, err := signerFromKeyFile(keyPath)
-			if err == nil {
-				authMethods = append(authMethods, ssh.PublicKeys(signer))
-			}
+	client, err := connect(host, opts, via)
+	if err != nil {
+		if via != nil {
+			via.Close()
 		}
+		return nil, err
 	}
 
-	clientConfig := &ssh.ClientConfig{
-		User:            username,
-		Auth:            authMethods,                 // 預設先嘗試 PublicKeys 認證
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(), // 實際生產環境中應使用已知主機金鑰驗證
+	if via != nil {
+		// 關閉最後的連線時一併關閉跳板
+		go func() {
+			client.Wait()
+			via.Close()
+		}()
 	}
 
-	// 嘗試連線
-	client, err := ssh.Dial("tcp", addr, clientConfig)
+	return client, nil
+}
 
-	// 5. 如果連線失敗, 且錯誤提示是權限不足 (可能需要密碼), 則提示使用者輸入密碼
-	if err != nil && strings.Contains(err.Error(), "unable to authenticate") {
-		fmt.Printf("使用者密碼: ")
+// connect 以已經套用 ssh 設定檔的 opts 連線到 host. via 不為 nil 時經由這條 SSH 連線建立 TCP 通道.
+func connect(host string, opts ConnectOptions, via *ssh.Client) (*ssh.Client, error) {
+	var (
+		dialer Dialer = via
+		err    error
+	)
+	if via == nil {
+		dialer, err = newDialer(opts)
+		if err != nil {
+			return nil, err
+		}
+	}
 
-		// 安全地從終端機讀取密碼, 不顯示回顯
-		passwordBytes, err := term.ReadPassword(int(syscall.Stdin))
-		fmt.Println() // 讀取完畢後換行
+	portStr := "22"
+	if opts.Port > 0 {
+		portStr = strconv.FormatUint(uint64(opts.Port), 10)
+	}
+	addr := net.JoinHostPort(host, portStr)
 
+	// 命令列與 ssh 設定檔都沒有指定私鑰時, 嘗試所有預設的私鑰
+	keys := opts.Keys
+	if opts.ForcePassword {
+		keys = nil
+	} else if len(keys) == 0 {
+		keys = defaultKeys()
+	}
+
+	hostKeys, err := newHostKeyChecker(opts.StrictHostKeyChecking)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		agentClient agent.ExtendedAgent
+		agentConn   net.Conn
+		forwarding  bool
+	)
+	if !opts.ForcePassword && (!opts.NoAgent || opts.ForwardAgent) {
+		agentClient, agentConn, err = dialAgent()
 		if err != nil {
-			return nil, fmt.Errorf("密碼錯誤: %w", err)
+			eprintf("[警告] %v\n", err)
+		}
+	}
+	defer func() {
+		// 轉送 ssh-agent 時, 連線要保持到 SSH 連線結束
+		if agentConn != nil && !forwarding {
+			agentConn.Close()
 		}
+	}()
 
-		password := string(passwordBytes)
+	// 非互動式的密碼來源, 讓排程或 CI 中不必詢問使用者
+	var password *string
+	if secret, ok, err := readSecret(opts.PasswordFile, opts.PasswordEnv); err != nil {
+		return nil, err
+	} else if ok {
+		password = &secret
+	} else {
+		// 曾經以密碼登入過 (例如重新連線時), 直接使用同一個密碼
+		password = cachedPassword(opts.Username, addr)
+	}
+	if secret, ok, err := readSecret(opts.PassphraseFile, opts.PassphraseEnv); err != nil {
+		return nil, err
+	} else if ok {
+		addPassphrase([]byte(secret))
+	}
 
-		// 使用密碼重新配置 Auth
-		clientConfig.Auth = []ssh.AuthMethod{
-			ssh.Password(password),
+	// 準備身份驗證方法, ssh-agent 中的身分優先於私鑰檔案
+	tracker := &identityTracker{}
+	var signers []ssh.Signer
+	if !opts.NoAgent {
+		comments := agentComments(agentClient)
+		for _, signer := range agentSigners(agentClient) {
+			name := "ssh-agent: " + comments[string(signer.PublicKey().Marshal())]
+			signers = append(signers, withName(signer, name, tracker))
 		}
+	}
+	signers = append(signers, loadKeySigners(keys, tracker)...)
 
-		// 使用密碼認證再次嘗試連線
-		client, err = ssh.Dial("tcp", addr, clientConfig)
-		if err != nil {
-			return nil, fmt.Errorf("密碼認證連線失敗: %w", err)
-		}
+	// 私鑰旁邊的 -cert.pub 與 CertificateFile 指定的憑證, 也適用於 ssh-agent 中對應的私鑰
+	if len(signers) > 0 {
+		certFiles := certificateFiles(append(slices.Clone(keys), defaultPrivateKeys...))
+		certFiles = append(certFiles, opts.CertificateFiles...)
+		signers = withCertificates(signers, loadCertificates(certFiles))
+	}
 
-		return client, nil
+	// 依序嘗試 publickey, keyboard-interactive 與密碼, 與 OpenSSH 預設的順序相同
+	var authMethods []ssh.AuthMethod
+	if len(signers) > 0 {
+		authMethods = append(authMethods, ssh.PublicKeys(signers...))
+	}
+	authMethods = append(authMethods, interactiveAuthMethods(opts.Username, host, tracker, password)...)
+
+	clientConfig := &ssh.ClientConfig{
+		User:            opts.Username,
+		Auth:            authMethods,
+		HostKeyCallback: hostKeys.callback,
+		BannerCallback:  ssh.BannerDisplayStderr(),
+	}
+	if err := applyAlgorithms(clientConfig, opts, hostKeys.algorithms(addr)); err != nil {
+		return nil, err
+	}
 
-	} else if err != nil {
-		// 其他連線錯誤 (如主機找不到、連線逾時等)
+	client, err := dialSSH(dialer, addr, clientConfig, opts.ConnectTimeout)
+	if err != nil {
 		return nil, fmt.Errorf("SSH 連線失敗: %w", err)
 	}
 
+	if opts.Verbose {
+		printAlgorithms(client)
+	}
+	if tracker.last != "" {
+		printf("以 %s 認證成功\n", tracker.last)
+	}
+	if (tracker.last == passwordIdentity || tracker.last == keyboardInteractiveIdentity) && tracker.password != "" {
+		cachePassword(opts.Username, addr, tracker.password)
+	}
+
+	if opts.ForwardAgent {
+		if agentClient == nil {
+			eprintf("[警告] 沒有可用的 ssh-agent, 無法轉送\n")
+		} else if err := agent.ForwardToAgent(client, agentClient); err != nil {
+			client.Close()
+			return nil, fmt.Errorf("設定 ssh-agent 轉送: %w", err)
+		} else {
+			forwarding = true
+			go func() {
+				client.Wait()
+				agentConn.Close()
+			}()
+		}
+	}
+
+	if opts.ServerAliveInterval > 0 {
+		go keepAlive(client, opts.ServerAliveInterval, opts.ServerAliveCountMax)
+	}
+
 	return client, nil
 }
 
-// 展開路徑中的 ~ (例如 ~/.ssh/id_rsa)
-func expandPath(path string) (string, error) {
-	if strings.HasPrefix(path, "~") {
-		homeDir, err := os.UserHomeDir()
-		if err != nil {
-			return "", err
-		}
-		return filepath.Join(homeDir, path[1:]), nil
+// newDialer 依照 opts 決定直接連線, 經由 ProxyCommand 或經由代理伺服器連線
+func newDialer(opts ConnectOptions) (Dialer, error) {
+	if opts.Dialer != nil {
+		return opts.Dialer, nil
 	}
-	return path, nil
+
+	if opts.ProxyCommand != "" && opts.ProxyCommand != "none" {
+		return &proxyCommandDialer{command: opts.ProxyCommand, username: opts.Username}, nil
+	}
+
+	dialer := &net.Dialer{}
+	if opts.Proxy != "" {
+		return NewProxyDialer(opts.Proxy, dialer)
+	}
+
+	return dialer, nil
 }
 
-// 檢查預設路徑中是否存在私鑰檔案，並傳回第一個找到的路徑
-func findDefaultKey() string {
-	curOS := runtime.GOOS
-	if curOS == "linux" || curOS == "darwin" || curOS == "windows" {
-		for _, path := range defaultPrivateKeys {
-			keyPath, err := expandPath(path)
-			if err == nil {
-				// 檢查檔案是否存在且可讀
-				if _, err := os.Stat(keyPath); err == nil {
-					return path
-				}
-			}
+// dialSSH 經由 dialer 建立連線並完成 SSH 交握與認證.
+// 建立連線與交換金鑰必須在 timeout 內完成; 收到主機金鑰之後可能要詢問使用者, 所以不再限制時間.
+func dialSSH(dialer Dialer, addr string, config *ssh.ClientConfig, timeout time.Duration) (*ssh.Client, error) {
+	conn, err := dialTimeout(dialer, addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	var timedOut atomic.Bool
+	timer := time.AfterFunc(timeout, func() {
+		timedOut.Store(true)
+		conn.Close()
+	})
+	defer timer.Stop()
+
+	// 第一次收到主機金鑰時停止計時. 之後重新交換金鑰 (rekey) 時還會再呼叫, 不再處理計時.
+	var keyReceived atomic.Bool
+	timedConfig := *config
+	timedConfig.HostKeyCallback = func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		if keyReceived.CompareAndSwap(false, true) && !timer.Stop() {
+			return fmt.Errorf("交握逾時")
+		}
+		return config.HostKeyCallback(hostname, remote, key)
+	}
+
+	c, chans, reqs, err := ssh.NewClientConn(conn, addr, &timedConfig)
+	if err != nil {
+		conn.Close()
+		if timedOut.Load() {
+			return nil, fmt.Errorf("與 %s 交握逾時 (%s)", addr, timeout)
 		}
+		return nil, err
 	}
 
-	return ""
+	return ssh.NewClient(c, chans, reqs), nil
 }
 
-// 從檔案路徑建立 ssh.Signer
-func signerFromKeyFile(file string) (ssh.Signer, error) {
-	buf, err := os.ReadFile(file)
+// dialTimeout 在 timeout 內建立連線. 不是每一種 Dialer 都支援逾時 (如跳板主機, ProxyCommand), 所以統一在這裡處理.
+func dialTimeout(dialer Dialer, addr string, timeout time.Duration) (net.Conn, error) {
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+
+	done := make(chan result, 1)
+	go func() {
+		conn, err := dialer.Dial("tcp", addr)
+		done <- result{conn, err}
+	}()
+
+	select {
+	case r := <-done:
+		return r.conn, r.err
+	case <-time.After(timeout):
+		// 逾時之後才建立的連線不會再用到
+		go func() {
+			if r := <-done; r.conn != nil {
+				r.conn.Close()
+			}
+		}()
+		return nil, fmt.Errorf("連線至 %s 逾時 (%s)", addr, timeout)
+	}
+}
+
+// applyHostConfig 以 ssh 設定檔補上 opts 中沒有指定的設定, 傳回實際要連線的主機名稱.
+func applyHostConfig(alias string, opts ConnectOptions) (string, ConnectOptions, error) {
+	config, err := LoadHostConfig(alias)
 	if err != nil {
-		return nil, err
+		return "", opts, err
 	}
 
-	// 嘗試解析不帶密碼保護的私鑰
-	signer, err := ssh.ParsePrivateKey(buf)
-	if err == nil {
-		return signer, nil
+	host := alias
+	if config.HostName != "" {
+		host = config.HostName
 	}
 
-	// 如果解析失敗 (可能是因為私鑰有密碼保護), 則提示使用者輸入金鑰密碼
-	// TODO: 測試有密碼保護的 private key
-	if strings.Contains(err.Error(), "cannot decode private keys") {
-		fmt.Printf("輸入私鑰檔案密碼: ")
-		passphraseBytes, err := term.ReadPassword(int(syscall.Stdin))
-		fmt.Println()
-		if err != nil {
-			return nil, fmt.Errorf("私鑰密碼輸入失敗: %w", err)
+	if opts.Port == 0 {
+		opts.Port = config.Port
+	}
+
+	if opts.Username == "" {
+		opts.Username = config.User
+	}
+	if opts.Username == "" {
+		opts.Username = localUsername()
+	}
+
+	// 命令列指定的私鑰先試, 再試設定檔中的 IdentityFile
+	opts.Keys = slices.Concat(opts.Keys, config.IdentityFiles)
+
+	if opts.ConnectTimeout == 0 {
+		opts.ConnectTimeout = cmp.Or(config.ConnectTimeout, defaultConnectTimeout)
+	}
+
+	if opts.ServerAliveInterval == 0 {
+		opts.ServerAliveInterval = cmp.Or(config.ServerAliveInterval, defaultServerAliveInterval)
+	}
+
+	if opts.ServerAliveCountMax == 0 {
+		opts.ServerAliveCountMax = cmp.Or(config.ServerAliveCountMax, defaultServerAliveCountMax)
+	}
+
+	opts.CertificateFiles = slices.Concat(opts.CertificateFiles, config.CertificateFiles)
+
+	// 命令列指定了 --proxy 或 --proxy-command 時, 不再使用設定檔中的 ProxyJump 與 ProxyCommand,
+	// 否則設定檔的 ProxyCommand 會取代命令列的 --proxy
+	if opts.Proxy == "" && opts.ProxyCommand == "" {
+		if opts.ProxyJump == "" {
+			opts.ProxyJump = config.ProxyJump
 		}
-		passphrase := passphraseBytes
+		opts.ProxyCommand = config.ProxyCommand
+	}
 
-		// 使用密碼再次嘗試解析私鑰
-		signer, err = ssh.ParsePrivateKeyWithPassphrase(buf, passphrase)
-		if err != nil {
-			return nil, fmt.Errorf("使用密碼解析私鑰失敗: %w", err)
+	opts.Ciphers = cmp.Or(opts.Ciphers, config.Ciphers)
+	opts.KexAlgorithms = cmp.Or(opts.KexAlgorithms, config.KexAlgorithms)
+	opts.MACs = cmp.Or(opts.MACs, config.MACs)
+	opts.HostKeyAlgorithms = cmp.Or(opts.HostKeyAlgorithms, config.HostKeyAlgorithms)
+
+	return host, opts, nil
+}
+
+// keepAlive 定期送出 keepalive 請求, 避免閒置的連線被防火牆或 NAT 切斷.
+// 連續 countMax 次沒有回應時關閉連線, 讓進行中的傳輸立即失敗, 而不是無聲無息地卡住.
+func keepAlive(client *ssh.Client, interval time.Duration, countMax int) {
+	done := make(chan struct{})
+	go func() {
+		client.Wait()
+		close(done)
+	}()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	// 同時只有一個等待回應的請求, 容量 1 讓 keepAlive 結束後它也不會卡住
+	replies := make(chan error, 1)
+	pending := false
+	missed := 0
+	for {
+		select {
+		case <-done:
+			return
+		case err := <-replies:
+			if err != nil {
+				return
+			}
+			pending = false
+			missed = 0
+		case <-ticker.C:
+			if pending {
+				missed++
+				if missed >= countMax {
+					eprintf("[警告] 伺服器 %s 沒有回應, 中斷連線\n", client.RemoteAddr())
+					client.Close()
+					return
+				}
+				continue
+			}
+
+			pending = true
+			go func() {
+				_, _, err := client.SendRequest("keepalive@openssh.com", true, nil)
+				replies <- err
+			}()
 		}
+	}
+}
+
+// localUsername 傳回本地的使用者名稱, 作為沒有指定遠端使用者時的預設值
+func localUsername() string {
+	u, err := user.Current()
+	if err != nil {
+		return ""
+	}
 
-		return signer, nil
+	// Windows 的使用者名稱包含網域, 如 DOMAIN\user
+	name := u.Username
+	if idx := strings.LastIndex(name, "\\"); idx >= 0 {
+		name = name[idx+1:]
 	}
 
-	// 其他解析錯誤
-	return nil, fmt.Errorf("無法解析私鑰: %w", err)
+	return name
+}
+
+// 展開路徑中的 ~ (例如 ~/.ssh/id_rsa)
+func expandPath(path string) (string, error) {
+	if strings.HasPrefix(path, "~") {
+		homeDir, err := os.UserHomeDir()
+		if err != nil {
+			return "", err
+		}
+		return filepath.Join(homeDir, path[1:]), nil
+	}
+	return path, nil
 }
@@ -0,0 +1,257 @@
+package transport
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+)
+
+// 差異傳輸的區塊大小範圍, 以及每個指令最多帶的新資料
+const (
+	minDeltaBlockSize = 2 << 10
+	maxDeltaBlockSize = 128 << 10
+	maxLiteralSize    = 64 << 10
+)
+
+// deltaBlockSize 依照舊檔案的大小決定區塊大小. 與 rsync 相同取平方根, 檔案越大區塊越大, 簽章的數量不會太多.
+func deltaBlockSize(size int64) int {
+	n := int(math.Sqrt(float64(size))) &^ 7
+	return min(max(n, minDeltaBlockSize), maxDeltaBlockSize)
+}
+
+// blockSignature 是舊檔案中一個區塊的簽章. Weak 用來快速找出可能相同的區塊, 再以 Strong 確認.
+type blockSignature struct {
+	Weak   uint32
+	Strong [16]byte
+}
+
+// deltaOp 是重建新檔案的一個指令: Count 大於 0 時複製舊檔案從第 Block 個起的 Count 個區塊, 否則寫入 Data.
+// End 表示結束, Sum 是新檔案的 SHA-256; Err 不是空字串時表示產生差異的一方發生錯誤.
+type deltaOp struct {
+	Block int64
+	Count int64
+	Data  []byte
+	End   bool
+	Sum   []byte
+	Err   string
+}
+
+// deltaStats 記錄新檔案中沿用舊檔案以及實際傳送的位元組數
+type deltaStats struct {
+	matched int64
+	literal int64
+}
+
+// rollingSum 是 rsync 使用的滾動檢查碼, 視窗移動一個位元組時不必重新計算整個區塊
+type rollingSum struct {
+	a, b uint32
+	n    uint32
+}
+
+func newRollingSum(block []byte) rollingSum {
+	s := rollingSum{n: uint32(len(block))}
+	for i, c := range block {
+		s.a += uint32(c)
+		s.b += uint32(len(block)-i) * uint32(c)
+	}
+
+	return s
+}
+
+// roll 將視窗往後移動一個位元組, out 是移出的位元組, in 是移入的位元組
+func (s *rollingSum) roll(out byte, in byte) {
+	s.a += uint32(in) - uint32(out)
+	s.b += s.a - s.n*uint32(out)
+}
+
+func (s *rollingSum) sum() uint32 {
+	return s.a&0xffff | s.b<<16
+}
+
+func strongSum(block []byte) [16]byte {
+	var sum [16]byte
+	full := sha256.Sum256(block)
+	copy(sum[:], full[:])
+
+	return sum
+}
+
+// signatures 計算 r 中每個完整區塊的簽章. 最後不足一個區塊的部分不計算, 一律當作新資料傳送.
+func signatures(r io.Reader, blockSize int) ([]blockSignature, error) {
+	var sigs []blockSignature
+	block := make([]byte, blockSize)
+	for {
+		if _, err := io.ReadFull(r, block); err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				return sigs, nil
+			}
+			return nil, err
+		}
+
+		rolling := newRollingSum(block)
+		sigs = append(sigs, blockSignature{Weak: rolling.sum(), Strong: strongSum(block)})
+	}
+}
+
+// computeDelta 比對新檔案 src 與舊檔案的簽章 sigs, 以 emit 送出重建新檔案的指令, 最後送出 End.
+func computeDelta(src io.Reader, sigs []blockSignature, blockSize int, emit func(op deltaOp) error) (deltaStats, error) {
+	index := make(map[uint32][]int, len(sigs))
+	for idx, sig := range sigs {
+		index[sig.Weak] = append(index[sig.Weak], idx)
+	}
+
+	hash := sha256.New()
+	src = io.TeeReader(src, hash)
+	encoder := &deltaEncoder{emit: emit}
+
+	// buf[start:] 是還沒處理的資料, 視窗是 buf[start:start+blockSize]
+	buf := make([]byte, 0, 4*blockSize)
+	start, eof := 0, false
+	var rolling rollingSum
+	fresh := true
+	for encoder.err == nil {
+		// 視窗之後至少要再有一個位元組才能滾動
+		if len(buf)-start <= blockSize && !eof {
+			buf = buf[:copy(buf[:cap(buf)], buf[start:])]
+			start = 0
+
+			n, err := io.ReadFull(src, buf[len(buf):cap(buf)])
+			buf = buf[:len(buf)+n]
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				eof = true
+			} else if err != nil {
+				return encoder.stats, fmt.Errorf("讀取來源檔: %w", err)
+			}
+		}
+
+		if len(buf)-start < blockSize {
+			encoder.literal(buf[start:])
+			break
+		}
+
+		window := buf[start : start+blockSize]
+		if fresh {
+			rolling = newRollingSum(window)
+			fresh = false
+		}
+		if idx, ok := matchBlock(index, sigs, rolling.sum(), window); ok {
+			encoder.block(idx, blockSize)
+			start += blockSize
+			fresh = true
+			continue
+		}
+
+		encoder.literal(buf[start : start+1])
+		if start+blockSize < len(buf) {
+			rolling.roll(buf[start], buf[start+blockSize])
+		} else {
+			fresh = true
+		}
+		start++
+	}
+
+	encoder.flush()
+	if encoder.err == nil {
+		encoder.err = emit(deltaOp{End: true, Sum: hash.Sum(nil)})
+	}
+
+	return encoder.stats, encoder.err
+}
+
+// matchBlock 在舊檔案的簽章中尋找與 window 相同的區塊
+func matchBlock(index map[uint32][]int, sigs []blockSignature, weak uint32, window []byte) (int, bool) {
+	candidates, ok := index[weak]
+	if !ok {
+		return 0, false
+	}
+
+	strong := strongSum(window)
+	for _, idx := range candidates {
+		if sigs[idx].Strong == strong {
+			return idx, true
+		}
+	}
+
+	return 0, false
+}
+
+// deltaEncoder 合併連續的區塊與新資料, 減少送出的指令數
+type deltaEncoder struct {
+	emit  func(op deltaOp) error
+	op    deltaOp
+	stats deltaStats
+	err   error
+}
+
+func (e *deltaEncoder) block(idx int, blockSize int) {
+	e.stats.matched += int64(blockSize)
+	if e.op.Count > 0 && e.op.Block+e.op.Count == int64(idx) {
+		e.op.Count++
+		return
+	}
+
+	e.flush()
+	e.op = deltaOp{Block: int64(idx), Count: 1}
+}
+
+func (e *deltaEncoder) literal(data []byte) {
+	e.stats.literal += int64(len(data))
+	if e.op.Count > 0 || len(e.op.Data) >= maxLiteralSize {
+		e.flush()
+	}
+	e.op.Data = append(e.op.Data, data...)
+}
+
+func (e *deltaEncoder) flush() {
+	if e.op.Count == 0 && len(e.op.Data) == 0 {
+		return
+	}
+
+	if e.err == nil {
+		e.err = e.emit(e.op)
+	}
+	e.op = deltaOp{}
+}
+
+// applyDelta 依照 next 傳回的指令, 以舊檔案 basis 與新資料重建新檔案寫到 dst, 並確認結果與新檔案的 SHA-256 相同
+func applyDelta(basis io.ReaderAt, blockSize int, next func() (deltaOp, error), dst io.Writer) (deltaStats, error) {
+	var stats deltaStats
+	hash := sha256.New()
+	w := io.MultiWriter(dst, hash)
+	for {
+		op, err := next()
+		if err != nil {
+			return stats, err
+		}
+		if op.Err != "" {
+			return stats, errors.New(op.Err)
+		}
+
+		if op.End {
+			if !bytes.Equal(op.Sum, hash.Sum(nil)) {
+				return stats, errors.New("重建的檔案與來源檔不符")
+			}
+			return stats, nil
+		}
+
+		if op.Count > 0 {
+			length := op.Count * int64(blockSize)
+			n, err := io.Copy(w, io.NewSectionReader(basis, op.Block*int64(blockSize), length))
+			if err != nil {
+				return stats, fmt.Errorf("讀取舊檔案: %w", err)
+			}
+			if n != length {
+				return stats, errors.New("舊檔案在傳輸中被修改")
+			}
+			stats.matched += n
+		}
+
+		if _, err := w.Write(op.Data); err != nil {
+			return stats, fmt.Errorf("寫入檔案: %w", err)
+		}
+		stats.literal += int64(len(op.Data))
+	}
+}
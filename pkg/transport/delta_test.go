@@ -0,0 +1,162 @@
+package transport
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"testing"
+)
+
+func TestDeltaRoundTrip(t *testing.T) {
+	const blockSize = minDeltaBlockSize
+
+	random := func(seed int64, n int) []byte {
+		b := make([]byte, n)
+		rand.New(rand.NewSource(seed)).Read(b)
+		return b
+	}
+	concat := func(parts ...[]byte) []byte {
+		return bytes.Join(parts, nil)
+	}
+
+	old := random(1, 10*blockSize+100)
+	modified := bytes.Clone(old)
+	modified[4*blockSize+7] ^= 0xff
+
+	tests := []struct {
+		name        string
+		old         []byte
+		new         []byte
+		wantLiteral int64
+	}{
+		{"相同", old, old, 100},
+		{"舊檔案是空的", nil, old, int64(len(old))},
+		{"新檔案是空的", old, nil, 0},
+		{"開頭插入", old, concat([]byte("inserted"), old), 8 + 100},
+		{"中間修改", old, modified, blockSize + 100},
+		{"結尾附加", old, concat(old, random(2, 3000)), 100 + 3000},
+		{"區塊換位", old, concat(old[5*blockSize:10*blockSize], old[:5*blockSize]), 0},
+		{"完全不同", old, random(3, len(old)), int64(len(old))},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sigs, err := signatures(bytes.NewReader(tt.old), blockSize)
+			if err != nil {
+				t.Fatalf("signatures() 錯誤: %v", err)
+			}
+			if len(sigs) != len(tt.old)/blockSize {
+				t.Errorf("signatures() 有 %d 個簽章, 預期 %d 個", len(sigs), len(tt.old)/blockSize)
+			}
+
+			var ops []deltaOp
+			stats, err := computeDelta(bytes.NewReader(tt.new), sigs, blockSize, func(op deltaOp) error {
+				ops = append(ops, op)
+				return nil
+			})
+			if err != nil {
+				t.Fatalf("computeDelta() 錯誤: %v", err)
+			}
+			if stats.literal != tt.wantLiteral || stats.matched+stats.literal != int64(len(tt.new)) {
+				t.Errorf("computeDelta() 沿用 %d, 傳送 %d 位元組, 預期傳送 %d", stats.matched, stats.literal, tt.wantLiteral)
+			}
+
+			var rebuilt bytes.Buffer
+			applied, err := applyDelta(bytes.NewReader(tt.old), blockSize, opsReader(ops), &rebuilt)
+			if err != nil {
+				t.Fatalf("applyDelta() 錯誤: %v", err)
+			}
+			if !bytes.Equal(rebuilt.Bytes(), tt.new) {
+				t.Errorf("重建的檔案 (%d 位元組) 與新檔案 (%d 位元組) 不同", rebuilt.Len(), len(tt.new))
+			}
+			if applied != stats {
+				t.Errorf("applyDelta() 統計 = %+v, 預期 %+v", applied, stats)
+			}
+		})
+	}
+}
+
+func TestApplyDeltaErrors(t *testing.T) {
+	const blockSize = minDeltaBlockSize
+
+	old := make([]byte, 4*blockSize)
+	rand.New(rand.NewSource(1)).Read(old)
+	sigs, err := signatures(bytes.NewReader(old), blockSize)
+	if err != nil {
+		t.Fatalf("signatures() 錯誤: %v", err)
+	}
+	var ops []deltaOp
+	if _, err := computeDelta(bytes.NewReader(old), sigs, blockSize, func(op deltaOp) error {
+		ops = append(ops, op)
+		return nil
+	}); err != nil {
+		t.Fatalf("computeDelta() 錯誤: %v", err)
+	}
+
+	changed := bytes.Clone(old)
+	changed[blockSize] ^= 0xff
+
+	tests := []struct {
+		name  string
+		basis []byte
+		ops   []deltaOp
+	}{
+		{"舊檔案被修改", changed, ops},
+		{"舊檔案被截短", old[:2*blockSize], ops},
+		{"另一方發生錯誤", old, []deltaOp{{Err: "讀取來源檔失敗"}}},
+		{"沒有結束", old, ops[:len(ops)-1]},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := applyDelta(bytes.NewReader(tt.basis), blockSize, opsReader(tt.ops), io.Discard); err == nil {
+				t.Error("applyDelta() 沒有錯誤")
+			}
+		})
+	}
+}
+
+func TestRollingSum(t *testing.T) {
+	data := make([]byte, 4096)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	for _, size := range []int{1, 7, 512} {
+		rolling := newRollingSum(data[:size])
+		for start := 1; start+size <= len(data); start++ {
+			rolling.roll(data[start-1], data[start+size-1])
+			if want := newRollingSum(data[start : start+size]); rolling.sum() != want.sum() {
+				t.Fatalf("區塊大小 %d, 位置 %d: 滾動的檢查碼 %08x, 預期 %08x", size, start, rolling.sum(), want.sum())
+			}
+		}
+	}
+}
+
+func TestDeltaBlockSize(t *testing.T) {
+	tests := []struct {
+		size int64
+		want int
+	}{
+		{0, minDeltaBlockSize},
+		{1 << 20, minDeltaBlockSize},
+		{1 << 30, 32768},
+		{1 << 40, maxDeltaBlockSize},
+	}
+
+	for _, tt := range tests {
+		if got := deltaBlockSize(tt.size); got != tt.want {
+			t.Errorf("deltaBlockSize(%d) = %d, 預期 %d", tt.size, got, tt.want)
+		}
+	}
+}
+
+// opsReader 依序傳回 ops, 結束後傳回 io.EOF
+func opsReader(ops []deltaOp) func() (deltaOp, error) {
+	return func() (deltaOp, error) {
+		if len(ops) == 0 {
+			return deltaOp{}, io.EOF
+		}
+		op := ops[0]
+		ops = ops[1:]
+		return op, nil
+	}
+}
@@ -12,21 +12,40 @@ import (
 	"github.com/pkg/sftp"
 )
 
-// Download 從遠端下載一個檔案或目錄到本地指定的路徑.
+// Download 從遠端下載一個檔案或目錄到本地指定的路徑. 連線中斷時會重新連線, 從中斷的地方繼續.
+// opts.Jobs 大於 1 時, 目錄中的檔案會同時下載, 但目錄依照順序建立.
 func Download(
-	client *sftp.Client,
+	remote *Remote,
 	remotePath string,
 	localPath string,
-	excludes []string,
-	remoteSep string,
+	opts TransferOptions,
 ) error {
-	remoteInfo, err := client.Stat(remotePath)
-	if err != nil {
+	var remoteInfo os.FileInfo
+	if err := remote.retry(func(client *sftp.Client) (err error) {
+		remoteInfo, err = client.Stat(remotePath)
+		return err
+	}); err != nil {
 		return fmt.Errorf("取得遠端路徑資訊: %w", err)
 	}
 
+	opts.limiter = newRateLimiter(opts.LimitRate)
+	if localPath == StdioPath {
+		return downloadToStdout(remote, remotePath, remoteInfo, opts)
+	}
+
+	stats := &transferStats{}
 	if remoteInfo.IsDir() {
-		return downloadRemoteDir(client, remotePath, localPath, excludes, remoteSep)
+		if opts.Progress && !opts.DryRun {
+			printf("掃描遠端目錄 %s\n", remotePath)
+			files, bytes := scanRemote(remote, remotePath, opts)
+			stats.progress = newProgress(files, bytes, opts)
+		}
+
+		err := downloadRemoteDir(remote, remotePath, localPath, opts, stats)
+		stats.progress.finish()
+		if err != nil {
+			return err
+		}
 	} else {
 		if localInfo, err := os.Stat(localPath); err != nil {
 			if !os.IsNotExist(err) {
@@ -36,19 +55,74 @@ func Download(
 			localPath = filepath.Join(localPath, filepath.Base(remotePath))
 		}
 
-		return downloadRemoteFile(client, remotePath, localPath, remoteSep)
+		stats.progress = newProgress(1, remoteInfo.Size(), opts)
+		err := downloadIfChanged(remote, remotePath, remoteInfo, localPath, opts, stats)
+		stats.progress.finish()
+		if err != nil {
+			return err
+		}
+		if !opts.DryRun {
+			removeLocalPartial(localPath)
+		}
+	}
+
+	if opts.Skip != SkipNone || opts.DryRun {
+		stats.print()
+	}
+
+	if opts.Verify && !opts.DryRun {
+		return stats.verifyResult()
 	}
+
+	return nil
 }
 
-func createLocalDir(
-	client *sftp.Client,
-	remoteDir string,
-	localDir string,
-	remoteSep string,
+// downloadIfChanged 依照 opts.Skip 判斷是否需要下載, 需要時才下載 remotePath
+func downloadIfChanged(
+	remote *Remote,
+	remotePath string,
+	remoteStat os.FileInfo,
+	localPath string,
+	opts TransferOptions,
+	stats *transferStats,
 ) error {
-	remoteStat, err := client.Stat(remoteDir)
-	if err != nil {
-		return fmt.Errorf("取得遠端目錄資訊: %w", err)
+	if skip, err := skipDownload(remote, remotePath, remoteStat, localPath, opts); err != nil {
+		return err
+	} else if skip {
+		stats.skipped.Add(1)
+		stats.progress.skip(remoteStat.Size())
+		return nil
+	}
+
+	if opts.DryRun {
+		action := "建立"
+		if util.PathExists(localPath) {
+			action = "覆蓋"
+		}
+		opts.printf("%s本地檔案 %s (%s)\n", action, localPath, util.FormatSize(remoteStat.Size()))
+	} else {
+		fp := stats.progress.file(localPath, remoteStat.Size())
+		err := downloadRemoteFile(remote, remotePath, localPath, opts, fp)
+		fp.finish()
+		if err != nil {
+			return err
+		}
+
+		if opts.Verify {
+			if err := verifyTransfer(remote, remotePath, localPath, stats); err != nil {
+				return err
+			}
+		}
+	}
+	stats.copied.Add(1)
+	stats.bytes.Add(remoteStat.Size())
+
+	return nil
+}
+
+func createLocalDir(remoteStat os.FileInfo, localDir string, opts TransferOptions) error {
+	if opts.DryRun {
+		return nil
 	}
 
 	mode := remoteStat.Mode()
@@ -63,34 +137,37 @@ func createLocalDir(
 }
 
 func downloadRemoteDir(
-	client *sftp.Client,
+	remote *Remote,
 	remoteDir string,
 	localDir string,
-	excludes []string,
-	remoteSep string,
+	opts TransferOptions,
+	stats *transferStats,
 ) error {
-	remoteDir = util.ReplaceSepWith(remoteDir, remoteSep)
+	remoteDir = util.ReplaceSepWith(remoteDir, remote.Sep())
 
 	localRoot := localDir
 	if localRoot == "." {
 		localRoot = filepath.Base(remoteDir)
 	}
 
-	walker := client.Walk(remoteDir)
-	for walker.Step() {
-		if walker.Err() != nil {
-			return fmt.Errorf("開始搜尋目錄: %w", walker.Err())
+	var localDirs []string
+	m := newMirror()
+	pool := newWorkerPool(opts.Jobs)
+	err := remote.walk(remoteDir, func(remotePath string, remoteStat os.FileInfo) error {
+		if isMatched(remotePath, opts.Excludes) {
+			return errSkipDir
 		}
-
-		remotePath := walker.Path()
-		if isMatched(remotePath, excludes) {
-			continue
+		if !remoteStat.IsDir() && isPartialName(remoteStat.Name()) {
+			// 其他 scopy 寫入中的暫存檔
+			return nil
 		}
 
 		relPath, err := filepath.Rel(remoteDir, remotePath)
 		if err != nil {
 			return fmt.Errorf("取得相對路徑: %w", err)
 		}
+		// 符號連結指向的目錄沒有走訪內容, 不能據此刪除目的地中對應目錄的內容
+		m.add(relPath, remoteStat.IsDir() && !isLinkedDir(remoteStat))
 
 		if relPath == "." {
 			if util.PathExists(localRoot) {
@@ -98,83 +175,222 @@ func downloadRemoteDir(
 					return fmt.Errorf("本地路徑 (%s) 存在且不是目錄", localRoot)
 				}
 			} else {
-				fmt.Printf("建立本地目錄 %s\n", localRoot)
-				if err := createLocalDir(client, remotePath, localRoot, remoteSep); err != nil {
+				opts.printf("建立本地目錄 %s\n", localRoot)
+				if err := createLocalDir(remoteStat, localRoot, opts); err != nil {
 					return fmt.Errorf("建立本地目錄: %w", err)
 				}
 			}
+			localDirs = append(localDirs, localRoot)
 		} else {
-			remoteStat, err := client.Stat(remotePath)
-			if err != nil {
-				return fmt.Errorf("取得遠端目錄資訊: %w", err)
-			}
-
 			localPath := filepath.Join(localRoot, relPath)
 			if remoteStat.IsDir() {
-				fmt.Printf("建立本地目錄 %s\n", localPath)
-				if err := createLocalDir(client, remotePath, localPath, remoteSep); err != nil {
+				opts.printf("建立本地目錄 %s\n", localPath)
+				if err := createLocalDir(remoteStat, localPath, opts); err != nil {
 					return fmt.Errorf("建立本地目錄: %w", err)
 				}
+				localDirs = append(localDirs, localPath)
 			} else {
-				if err := downloadRemoteFile(client, remotePath, localPath, remoteSep); err != nil {
-					return fmt.Errorf("下載遠端檔案: %w", err)
+				submitted := pool.submit(func() error {
+					if err := downloadIfChanged(remote, remotePath, remoteStat, localPath, opts, stats); err != nil {
+						return fmt.Errorf("下載遠端檔案: %w", err)
+					}
+					return nil
+				})
+				if !submitted {
+					return errTransferStopped
 				}
 			}
 		}
+
+		return nil
+	})
+
+	if err := pool.wait(err); err != nil {
+		return err
+	}
+
+	if opts.Delete {
+		if err := deleteLocalExtraneous(localRoot, m, opts); err != nil {
+			return fmt.Errorf("刪除多餘的本地項目: %w", err)
+		}
+	}
+
+	// 全部下載完成後, 剩下的暫存檔都是之前中斷時留下, 而來源已經不存在的檔案
+	if !opts.DryRun {
+		cleanupLocalPartials(localDirs)
 	}
 
 	return nil
 }
 
 func downloadRemoteFile(
-	client *sftp.Client,
+	remote *Remote,
 	remotePath string,
 	localPath string,
-	remoteSep string,
+	opts TransferOptions,
+	fp *fileProgress,
 ) error {
-	remotePath = util.ReplaceSepWith(remotePath, remoteSep)
+	remotePath = util.ReplaceSepWith(remotePath, remote.Sep())
 
-	fmt.Printf("開啟遠端檔案 %s\n", localPath)
-	remoteFile, err := client.Open(remotePath)
-	if err != nil {
-		return fmt.Errorf("開啟遠端檔案: %w", err)
+	// 先寫到同目錄下的暫存檔, 完成後才改名, 其他程式不會看到只複製一半的檔案
+	target := localPath
+	if !opts.Inplace {
+		target = localPartialPath(localPath)
 	}
-	defer remoteFile.Close()
 
-	if err := os.MkdirAll(filepath.Dir(localPath), 0o755); err != nil {
-		return fmt.Errorf("建立本地目錄: %w", err)
-	}
+	var (
+		localFile  *os.File
+		remoteStat os.FileInfo
+		written    int64
+		chunked    bool
+	)
+	defer func() {
+		if localFile != nil {
+			localFile.Close()
+		}
+	}()
 
-	fmt.Printf("建立本地檔案 %s\n", localPath)
-	localFile, err := os.Create(localPath)
-	if err != nil {
-		return fmt.Errorf("建立本地檔案: %w", err)
+	// 連線中斷後重新開啟遠端檔案, 從已經寫入本地的位置繼續
+	if err := remote.retry(func(client *sftp.Client) error {
+		if localFile == nil {
+			printf("開啟遠端檔案 %s\n", localPath)
+		} else {
+			printf("從 %d 位元組繼續下載 %s\n", written, localPath)
+		}
+		remoteFile, err := client.Open(remotePath)
+		if err != nil {
+			return fmt.Errorf("開啟遠端檔案: %w", err)
+		}
+		defer remoteFile.Close()
+
+		if localFile == nil {
+			if remoteStat, err = remoteFile.Stat(); err != nil {
+				return fmt.Errorf("取得遠端檔案資訊: %w", err)
+			}
+
+			if err := os.MkdirAll(filepath.Dir(localPath), 0o755); err != nil {
+				return fmt.Errorf("建立本地目錄: %w", err)
+			}
+
+			// 本地已經有舊檔案時只下載不同的部分
+			if opts.Delta && !opts.Inplace {
+				if localFile, err = downloadDelta(remote, remotePath, localPath, target, opts, fp); err != nil {
+					eprintf("[警告] 差異下載 %s 失敗, 改為完整下載: %v\n", localPath, err)
+				} else if localFile != nil {
+					return nil
+				}
+			}
+
+			if opts.Resume {
+				if localFile, written, err = openResumable(target, localPath, remoteFile, remoteStat.Size(), opts); err != nil {
+					return err
+				}
+			} else {
+				printf("建立本地檔案 %s\n", localPath)
+				if localFile, err = os.Create(target); err != nil {
+					return fmt.Errorf("建立本地檔案: %w", err)
+				}
+			}
+
+			// 大檔案改為分段同時下載
+			if chunked = useChunks(remoteStat.Size(), opts); chunked {
+				fp.set(written)
+				return nil
+			}
+		}
+
+		if _, err := remoteFile.Seek(written, io.SeekStart); err != nil {
+			return fmt.Errorf("移動遠端檔案位置: %w", err)
+		}
+		if _, err := localFile.Seek(written, io.SeekStart); err != nil {
+			return fmt.Errorf("移動本地檔案位置: %w", err)
+		}
+
+		fp.set(written)
+		n, err := io.Copy(opts.limiter.writer(fp.writer(localFile)), remoteFile)
+		written += n
+		if err != nil {
+			return fmt.Errorf("複製檔案: %w", err)
+		}
+
+		return nil
+	}); err != nil {
+		return err
 	}
-	defer localFile.Close()
 
-	_, err = io.Copy(localFile, remoteFile)
-	if err != nil {
-		return fmt.Errorf("複製檔案: %w", err)
+	if chunked {
+		if err := downloadChunks(remote, remotePath, localFile, localJournalPath(localPath), remoteStat.Size(), written, opts, fp); err != nil {
+			return err
+		}
 	}
 
 	// Windows 必須確保緩衝區寫入磁碟才能做 chtime 與 chmod
 	if err := localFile.Sync(); err != nil {
-		fmt.Printf("[警告] 無法同步本地檔案: %v", err)
+		return fmt.Errorf("同步本地檔案 (%s): %w", localPath, err)
+	}
+
+	mtime := remoteStat.ModTime()
+	if err := os.Chtimes(target, mtime, mtime); err != nil {
+		return fmt.Errorf("設定本地檔案 (%s) 的修改時間: %w", localPath, err)
+	}
+	if err := os.Chmod(target, remoteStat.Mode()); err != nil {
+		return fmt.Errorf("設定本地檔案 (%s) 的權限: %w", localPath, err)
+	}
+
+	if target != localPath {
+		// Windows 不能將開啟中的檔案改名
+		localFile.Close()
+		localFile = nil
+		if err := os.Rename(target, localPath); err != nil {
+			return fmt.Errorf("暫存檔改名: %w", err)
+		}
 	}
 
-	remoteStat, err := client.Stat(remotePath)
+	return nil
+}
+
+// openResumable 開啟本地檔案 target 準備續傳. 檔案不存在或不是 remoteFile 中斷的下載結果時清空它, 從頭開始;
+// 有分段記錄檔時截短到記錄中連續完成的部分.
+// localPath 是顯示給使用者的目的檔名稱.
+func openResumable(target string, localPath string, remoteFile *sftp.File, size int64, opts TransferOptions) (*os.File, int64, error) {
+	localFile, err := os.OpenFile(target, os.O_RDWR|os.O_CREATE, 0o644)
 	if err != nil {
-		// 只是無法複製屬性, 不管它
-		return nil
+		return nil, 0, fmt.Errorf("開啟本地檔案: %w", err)
 	}
 
-	mtime := remoteStat.ModTime()
-	os.Chtimes(localPath, mtime, mtime)
+	localStat, err := localFile.Stat()
+	if err != nil {
+		localFile.Close()
+		return nil, 0, fmt.Errorf("取得本地檔案資訊: %w", err)
+	}
 
-	mode := remoteStat.Mode()
-	os.Chmod(localPath, mode)
+	journalPath := localJournalPath(localPath)
+	trusted, journaled := readLocalJournal(journalPath)
+	if !journaled {
+		trusted = -1
+	}
 
-	return nil
+	offset, err := resumeOffset(localPath, localFile, localStat.Size(), trusted, remoteFile, size, opts.ResumeCheck)
+	if err != nil {
+		localFile.Close()
+		return nil, 0, err
+	}
+
+	if offset < localStat.Size() {
+		if offset == 0 {
+			printf("建立本地檔案 %s\n", localPath)
+		}
+		if err := localFile.Truncate(offset); err != nil {
+			localFile.Close()
+			return nil, 0, fmt.Errorf("截短本地檔案: %w", err)
+		}
+	}
+	// 截短後只剩連續完成的部分, 不再需要記錄檔
+	if journaled {
+		os.Remove(journalPath)
+	}
+
+	return localFile, offset, nil
 }
 
 func isMatched(path string, patterns []string) bool {
@@ -0,0 +1,390 @@
+package transport
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// DeltaServerFlag 讓 scopy 在遠端以差異傳輸的輔助程式執行, 經由 stdin/stdout 與本地的 scopy 溝通
+const DeltaServerFlag = "--delta-server"
+
+// 輔助程式啟動後先送出的識別字串, 用來確認遠端真的執行了相容的 scopy
+const deltaHello = "scopy-delta/1\n"
+
+// 輔助程式處理的要求
+const (
+	helperOpSignature = "signature" // 傳回 Path 的區塊簽章
+	helperOpDelta     = "delta"     // 依照 Signatures 傳回重建 Path 的指令
+	helperOpPatch     = "patch"     // 接收指令, 以 Path 為舊檔案重建到 Target
+)
+
+// errHelperUnavailable 遠端無法執行輔助程式
+var errHelperUnavailable = errors.New("遠端沒有可用的 scopy")
+
+type helperRequest struct {
+	Op         string
+	Path       string
+	Target     string
+	BlockSize  int
+	Signatures []blockSignature
+}
+
+// helperReply 是 signature 與 patch 的回應. Missing 表示 Path 不存在或不是一般檔案, 沒有可以沿用的內容.
+type helperReply struct {
+	BlockSize  int
+	Signatures []blockSignature
+	Missing    bool
+	Err        string
+}
+
+// ServeDelta 執行差異傳輸的輔助程式, 從 in 讀取要求, 將結果寫到 out, 直到 in 結束.
+func ServeDelta(in io.Reader, out io.Writer) error {
+	w := bufio.NewWriter(out)
+	if _, err := w.WriteString(deltaHello); err != nil {
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	dec := gob.NewDecoder(bufio.NewReader(in))
+	enc := gob.NewEncoder(w)
+	for {
+		var req helperRequest
+		if err := dec.Decode(&req); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		var err error
+		switch req.Op {
+		case helperOpSignature:
+			err = enc.Encode(serveSignature(req))
+		case helperOpDelta:
+			err = serveDelta(req, enc)
+		case helperOpPatch:
+			err = servePatch(req, dec, enc)
+		default:
+			err = enc.Encode(helperReply{Err: fmt.Sprintf("不支援的要求 %q", req.Op)})
+		}
+		if err != nil {
+			return err
+		}
+
+		if err := w.Flush(); err != nil {
+			return err
+		}
+	}
+}
+
+func serveSignature(req helperRequest) helperReply {
+	file, err := os.Open(req.Path)
+	if os.IsNotExist(err) {
+		return helperReply{Missing: true}
+	} else if err != nil {
+		return helperReply{Err: err.Error()}
+	}
+	defer file.Close()
+
+	stat, err := file.Stat()
+	if err != nil {
+		return helperReply{Err: err.Error()}
+	}
+	if !stat.Mode().IsRegular() || stat.Size() == 0 {
+		return helperReply{Missing: true}
+	}
+
+	blockSize := deltaBlockSize(stat.Size())
+	sigs, err := signatures(bufio.NewReader(file), blockSize)
+	if err != nil {
+		return helperReply{Err: err.Error()}
+	}
+
+	return helperReply{BlockSize: blockSize, Signatures: sigs}
+}
+
+func serveDelta(req helperRequest, enc *gob.Encoder) error {
+	file, err := os.Open(req.Path)
+	if err != nil {
+		return enc.Encode(deltaOp{Err: err.Error()})
+	}
+	defer file.Close()
+
+	var encodeErr error
+	_, err = computeDelta(file, req.Signatures, req.BlockSize, func(op deltaOp) error {
+		encodeErr = enc.Encode(op)
+		return encodeErr
+	})
+	if encodeErr != nil {
+		return encodeErr
+	}
+	if err != nil {
+		return enc.Encode(deltaOp{Err: err.Error()})
+	}
+
+	return nil
+}
+
+func servePatch(req helperRequest, dec *gob.Decoder, enc *gob.Encoder) error {
+	// 不論成敗都要讀完所有的指令, 才能繼續處理下一個要求
+	var (
+		decodeErr error
+		ended     bool
+	)
+	next := func() (op deltaOp, err error) {
+		if decodeErr = dec.Decode(&op); decodeErr != nil {
+			return op, decodeErr
+		}
+		ended = op.End
+		return op, nil
+	}
+	drain := func() error {
+		for !ended {
+			if _, err := next(); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	basis, err := os.Open(req.Path)
+	if err != nil {
+		if err := drain(); err != nil {
+			return err
+		}
+		return enc.Encode(helperReply{Err: err.Error()})
+	}
+	defer basis.Close()
+
+	target, err := os.Create(req.Target)
+	if err != nil {
+		if err := drain(); err != nil {
+			return err
+		}
+		return enc.Encode(helperReply{Err: err.Error()})
+	}
+	defer target.Close()
+
+	w := bufio.NewWriter(target)
+	_, err = applyDelta(basis, req.BlockSize, next, w)
+	if decodeErr != nil {
+		return decodeErr
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = target.Sync()
+	}
+	if err != nil {
+		if err := drain(); err != nil {
+			return err
+		}
+		return enc.Encode(helperReply{Err: err.Error()})
+	}
+
+	return enc.Encode(helperReply{})
+}
+
+// deltaHelper 是遠端執行中的輔助程式
+type deltaHelper struct {
+	session *ssh.Session
+	stdin   io.WriteCloser
+	w       *bufio.Writer
+	enc     *gob.Encoder
+	dec     *gob.Decoder
+	stderr  bytes.Buffer
+}
+
+// startHelper 在遠端執行 command DeltaServerFlag, 與它之間的傳輸受 limiter 限制. 遠端沒有相容的 scopy 時傳回 errHelperUnavailable.
+func (r *Remote) startHelper(command string, limiter *rateLimiter) (*deltaHelper, error) {
+	session, err := NewSession(r.sshClient(), false)
+	if err != nil {
+		return nil, err
+	}
+
+	h := &deltaHelper{session: session}
+	session.Stderr = &h.stderr
+	if h.stdin, err = session.StdinPipe(); err != nil {
+		session.Close()
+		return nil, err
+	}
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		session.Close()
+		return nil, err
+	}
+
+	if err := session.Start(command + " " + DeltaServerFlag); err != nil {
+		session.Close()
+		return nil, fmt.Errorf("%w: %v", errHelperUnavailable, err)
+	}
+
+	reader := bufio.NewReader(limiter.reader(stdout))
+	hello := make([]byte, len(deltaHello))
+	if _, err := io.ReadFull(reader, hello); err != nil || string(hello) != deltaHello {
+		h.stdin.Close()
+		session.Wait()
+		session.Close()
+		if msg := strings.TrimSpace(h.stderr.String()); msg != "" {
+			return nil, fmt.Errorf("%w: %s", errHelperUnavailable, msg)
+		}
+		return nil, errHelperUnavailable
+	}
+
+	h.w = bufio.NewWriter(limiter.writer(h.stdin))
+	h.enc = gob.NewEncoder(h.w)
+	h.dec = gob.NewDecoder(reader)
+
+	return h, nil
+}
+
+// send 送出 v 並立即寫到遠端
+func (h *deltaHelper) send(v any) error {
+	if err := h.enc.Encode(v); err != nil {
+		return err
+	}
+
+	return h.w.Flush()
+}
+
+// close 結束輔助程式. 不等待它結束, 因為失敗時它可能還在等待送出結果.
+func (h *deltaHelper) close() {
+	h.stdin.Close()
+	h.session.Close()
+}
+
+// helperFor 啟動 opts.DeltaHelper. 遠端無法執行時顯示一次警告, 之後的檔案不再嘗試, 傳回 nil.
+func helperFor(remote *Remote, opts TransferOptions) (*deltaHelper, error) {
+	if remote.noHelper.Load() {
+		return nil, nil
+	}
+
+	h, err := remote.startHelper(opts.DeltaHelper, opts.limiter)
+	if errors.Is(err, errHelperUnavailable) {
+		if remote.noHelper.CompareAndSwap(false, true) {
+			eprintf("[警告] 無法在遠端執行 %s, 改為完整複製: %v\n", opts.DeltaHelper, err)
+		}
+		return nil, nil
+	}
+
+	return h, err
+}
+
+// downloadDelta 以本地的 localPath 為舊檔案, 只下載與遠端 remotePath 不同的部分, 重建到 target.
+// localPath 不存在或無法使用輔助程式時傳回 nil, 由呼叫者完整下載.
+func downloadDelta(remote *Remote, remotePath string, localPath string, target string, opts TransferOptions, fp *fileProgress) (*os.File, error) {
+	basis, err := os.Open(localPath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("開啟本地檔案: %w", err)
+	}
+	defer basis.Close()
+
+	basisStat, err := basis.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("取得本地檔案資訊: %w", err)
+	}
+	if !basisStat.Mode().IsRegular() || basisStat.Size() == 0 {
+		return nil, nil
+	}
+
+	h, err := helperFor(remote, opts)
+	if h == nil {
+		return nil, err
+	}
+	defer h.close()
+
+	blockSize := deltaBlockSize(basisStat.Size())
+	sigs, err := signatures(bufio.NewReader(basis), blockSize)
+	if err != nil {
+		return nil, fmt.Errorf("計算本地檔案的簽章: %w", err)
+	}
+	if err := h.send(helperRequest{Op: helperOpDelta, Path: remotePath, BlockSize: blockSize, Signatures: sigs}); err != nil {
+		return nil, fmt.Errorf("送出簽章: %w", err)
+	}
+
+	printf("差異下載 %s\n", localPath)
+	localFile, err := os.Create(target)
+	if err != nil {
+		return nil, fmt.Errorf("建立本地檔案: %w", err)
+	}
+
+	w := bufio.NewWriter(fp.writer(localFile))
+	stats, err := applyDelta(basis, blockSize, func() (op deltaOp, err error) {
+		err = h.dec.Decode(&op)
+		return op, err
+	}, w)
+	if err == nil {
+		err = w.Flush()
+	}
+	if err != nil {
+		localFile.Close()
+		return nil, fmt.Errorf("差異下載: %w", err)
+	}
+	printf("%s: 沿用 %d 位元組, 下載 %d 位元組\n", localPath, stats.matched, stats.literal)
+
+	return localFile, nil
+}
+
+// uploadDelta 以遠端的 remotePath 為舊檔案, 只上傳 localFile 與它不同的部分, 重建到遠端的 target.
+// remotePath 不存在或無法使用輔助程式時傳回 false, 由呼叫者完整上傳.
+func uploadDelta(remote *Remote, localFile *os.File, remotePath string, target string, opts TransferOptions, fp *fileProgress) (bool, error) {
+	h, err := helperFor(remote, opts)
+	if h == nil {
+		return false, err
+	}
+	defer h.close()
+
+	if err := h.send(helperRequest{Op: helperOpSignature, Path: remotePath}); err != nil {
+		return false, fmt.Errorf("要求遠端檔案的簽章: %w", err)
+	}
+	var reply helperReply
+	if err := h.dec.Decode(&reply); err != nil {
+		return false, fmt.Errorf("接收遠端檔案的簽章: %w", err)
+	}
+	if reply.Err != "" {
+		return false, fmt.Errorf("計算遠端檔案的簽章: %s", reply.Err)
+	}
+	if reply.Missing {
+		return false, nil
+	}
+
+	printf("差異上傳 %s\n", remotePath)
+	if err := h.send(helperRequest{Op: helperOpPatch, Path: remotePath, Target: target, BlockSize: reply.BlockSize}); err != nil {
+		return false, fmt.Errorf("差異上傳: %w", err)
+	}
+	if _, err := localFile.Seek(0, io.SeekStart); err != nil {
+		return false, fmt.Errorf("移動本地檔案位置: %w", err)
+	}
+	stats, err := computeDelta(bufio.NewReader(fp.reader(localFile)), reply.Signatures, reply.BlockSize, func(op deltaOp) error {
+		return h.enc.Encode(op)
+	})
+	if err == nil {
+		err = h.w.Flush()
+	}
+	if err != nil {
+		return false, fmt.Errorf("差異上傳: %w", err)
+	}
+
+	reply = helperReply{}
+	if err := h.dec.Decode(&reply); err != nil {
+		return false, fmt.Errorf("差異上傳: %w", err)
+	}
+	if reply.Err != "" {
+		return false, fmt.Errorf("差異上傳: %s", reply.Err)
+	}
+	printf("%s: 沿用 %d 位元組, 上傳 %d 位元組\n", remotePath, stats.matched, stats.literal)
+
+	return true, nil
+}
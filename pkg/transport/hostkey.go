@@ -0,0 +1,254 @@
+package transport
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// 主機金鑰檢查模式, 意義與 OpenSSH 的 StrictHostKeyChecking 相同
+const (
+	HostKeyCheckAsk       = "ask"        // 未知主機詢問使用者, 金鑰變更則拒絕
+	HostKeyCheckYes       = "yes"        // 未知主機與金鑰變更都拒絕
+	HostKeyCheckNo        = "no"         // 未知主機自動加入, 金鑰變更只警告
+	HostKeyCheckAcceptNew = "accept-new" // 未知主機自動加入, 金鑰變更則拒絕
+)
+
+var (
+	userKnownHostsFile   = "~/.ssh/known_hosts"
+	globalKnownHostsFile = "/etc/ssh/ssh_known_hosts"
+)
+
+// trustedHostKeys 記錄這次執行中已經同意的主機金鑰, 以正規化的主機名稱為索引.
+// 每次連線 (包括重新連線) 都會建立新的 hostKeyChecker, 記錄放在這裡, 重新連線時才不必再問或再警告.
+var trustedHostKeys struct {
+	sync.Mutex
+	m map[string][]ssh.PublicKey
+}
+
+// isTrustedHostKey 判斷這次執行中是否已經同意過 hostname 的 key
+func isTrustedHostKey(hostname string, key ssh.PublicKey) bool {
+	trustedHostKeys.Lock()
+	defer trustedHostKeys.Unlock()
+
+	for _, trusted := range trustedHostKeys.m[knownhosts.Normalize(hostname)] {
+		if bytes.Equal(trusted.Marshal(), key.Marshal()) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// trustHostKey 記錄同意 hostname 的 key
+func trustHostKey(hostname string, key ssh.PublicKey) {
+	trustedHostKeys.Lock()
+	defer trustedHostKeys.Unlock()
+
+	if trustedHostKeys.m == nil {
+		trustedHostKeys.m = make(map[string][]ssh.PublicKey)
+	}
+	normalized := knownhosts.Normalize(hostname)
+	trustedHostKeys.m[normalized] = append(trustedHostKeys.m[normalized], key)
+}
+
+// hostKeyChecker 依照 known_hosts 驗證主機金鑰, 必要時將新金鑰寫回使用者的 known_hosts.
+type hostKeyChecker struct {
+	mode     string
+	userFile string
+	files    []string // 實際載入的 known_hosts 檔案
+	check    ssh.HostKeyCallback
+}
+
+func newHostKeyChecker(mode string) (*hostKeyChecker, error) {
+	switch mode {
+	case "":
+		mode = HostKeyCheckAsk
+	case HostKeyCheckAsk, HostKeyCheckYes, HostKeyCheckNo, HostKeyCheckAcceptNew:
+	default:
+		return nil, fmt.Errorf("不支援的主機金鑰檢查模式 %q", mode)
+	}
+
+	userFile, err := expandPath(userKnownHostsFile)
+	if err != nil {
+		return nil, fmt.Errorf("取得 known_hosts 路徑: %w", err)
+	}
+
+	// knownhosts.New 遇到不存在的檔案會失敗, 所以只載入存在的檔案
+	var files []string
+	for _, file := range []string{userFile, globalKnownHostsFile} {
+		if _, err := os.Stat(file); err == nil {
+			files = append(files, file)
+		}
+	}
+
+	check, err := knownhosts.New(files...)
+	if err != nil {
+		return nil, fmt.Errorf("讀取 known_hosts: %w", err)
+	}
+
+	return &hostKeyChecker{
+		mode:     mode,
+		userFile: userFile,
+		files:    files,
+		check:    check,
+	}, nil
+}
+
+// callback 傳回給 ssh.ClientConfig 使用的 HostKeyCallback.
+func (c *hostKeyChecker) callback(hostname string, remote net.Addr, key ssh.PublicKey) error {
+	if isTrustedHostKey(hostname, key) {
+		return nil
+	}
+
+	err := c.check(hostname, remote, key)
+	if err == nil {
+		return nil
+	}
+
+	var revokedErr *knownhosts.RevokedError
+	if errors.As(err, &revokedErr) {
+		return fmt.Errorf("主機 %s 的金鑰已被撤銷 (%s:%d)", hostname, revokedErr.Revoked.Filename, revokedErr.Revoked.Line)
+	}
+
+	var keyErr *knownhosts.KeyError
+	if !errors.As(err, &keyErr) {
+		return err
+	}
+
+	if len(keyErr.Want) > 0 {
+		// 金鑰與記錄不符, 可能遭到中間人攻擊
+		msg := hostKeyChangedMessage(hostname, key, keyErr.Want)
+		if c.mode == HostKeyCheckNo {
+			eprintf("[警告] %s\n", msg)
+			trustHostKey(hostname, key)
+			return nil
+		}
+
+		return errors.New(msg)
+	}
+
+	switch c.mode {
+	case HostKeyCheckYes:
+		return fmt.Errorf("主機 %s 不在 known_hosts 中 (%s 金鑰指紋 %s)", hostname, key.Type(), ssh.FingerprintSHA256(key))
+	case HostKeyCheckAsk:
+		printf("無法確認主機 %s 的真實性.\n", hostname)
+		printf("%s 金鑰指紋為 %s.\n", key.Type(), ssh.FingerprintSHA256(key))
+		accepted, err := confirm("確定要繼續連線嗎 (yes/no)? ")
+		if err != nil {
+			return fmt.Errorf("無法確認主機 %s 的金鑰, 可使用 --strict-host-key-checking accept-new: %w", hostname, err)
+		}
+		if !accepted {
+			return fmt.Errorf("使用者拒絕主機 %s 的金鑰", hostname)
+		}
+	}
+
+	trustHostKey(hostname, key)
+
+	if err := c.add(hostname, remote, key); err != nil {
+		// 寫不進去不影響這次連線, 只是下次還要再確認一次
+		eprintf("[警告] 無法寫入 %s: %v\n", c.userFile, err)
+	} else {
+		printf("已將主機 %s 的 %s 金鑰加入 %s\n", hostname, key.Type(), c.userFile)
+	}
+
+	return nil
+}
+
+// add 將主機金鑰附加到使用者的 known_hosts.
+func (c *hostKeyChecker) add(hostname string, remote net.Addr, key ssh.PublicKey) error {
+	if err := os.MkdirAll(filepath.Dir(c.userFile), 0o700); err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(c.userFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	// 直接連線時同時記錄 IP 位址. 經由代理或 ProxyCommand 時 remote 不是 *net.TCPAddr,
+	// 經由跳板時則是 0.0.0.0, 都不記錄
+	addresses := []string{hostname}
+	if tcpAddr, ok := remote.(*net.TCPAddr); ok && tcpAddr.IP != nil && !tcpAddr.IP.IsUnspecified() {
+		if ip := tcpAddr.String(); knownhosts.Normalize(ip) != knownhosts.Normalize(hostname) {
+			addresses = append(addresses, ip)
+		}
+	}
+
+	_, err = fmt.Fprintln(file, knownhosts.Line(addresses, key))
+	return err
+}
+
+// algorithms 傳回主機金鑰演算法的偏好順序. 已知主機的金鑰種類排在前面,
+// 避免伺服器出示另一種我們沒記錄的金鑰而被誤判為金鑰變更.
+// 只有 known_hosts 中有適用的 @cert-authority 時才要求主機憑證.
+func (c *hostKeyChecker) algorithms(hostname string) []string {
+	var preferred []string
+	if hasHostAuthority(c.files, hostname) {
+		for _, algo := range ssh.SupportedAlgorithms().HostKeys {
+			if strings.Contains(algo, "-cert-") {
+				preferred = append(preferred, algo)
+			}
+		}
+	}
+
+	// 用一把隨機金鑰查詢, 由 KeyError.Want 得知 known_hosts 記錄了哪些金鑰
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err == nil {
+		if probe, err := ssh.NewSignerFromKey(priv); err == nil {
+			var keyErr *knownhosts.KeyError
+			if err := c.check(hostname, &net.TCPAddr{}, probe.PublicKey()); errors.As(err, &keyErr) {
+				for _, known := range keyErr.Want {
+					for _, algo := range algorithmsForKeyType(known.Key.Type()) {
+						if !slices.Contains(preferred, algo) {
+							preferred = append(preferred, algo)
+						}
+					}
+				}
+			}
+		}
+	}
+
+	algos := preferred
+	for _, algo := range ssh.SupportedAlgorithms().HostKeys {
+		// 憑證需要 @cert-authority 才能驗證, 前面沒有加入的話就不使用
+		if strings.Contains(algo, "-cert-") || slices.Contains(algos, algo) {
+			continue
+		}
+		algos = append(algos, algo)
+	}
+
+	return algos
+}
+
+func hostKeyChangedMessage(hostname string, key ssh.PublicKey, want []knownhosts.KnownKey) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "主機 %s 的金鑰已經變更, 可能有人正在進行中間人攻擊!\n", hostname)
+	fmt.Fprintf(&b, "  收到: %s %s\n", key.Type(), ssh.FingerprintSHA256(key))
+	for _, known := range want {
+		fmt.Fprintf(&b, "  記錄: %s %s (%s:%d)\n", known.Key.Type(), ssh.FingerprintSHA256(known.Key), known.Filename, known.Line)
+	}
+	b.WriteString("若確定主機金鑰確實更換, 請先從 known_hosts 移除舊的記錄")
+
+	return b.String()
+}
+
+func algorithmsForKeyType(keyType string) []string {
+	if keyType == ssh.KeyAlgoRSA {
+		return []string{ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSA}
+	}
+
+	return []string{keyType}
+}
@@ -0,0 +1,196 @@
+package transport
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// useKnownHosts 以 content 作為使用者的 known_hosts, 不使用系統的 known_hosts, 並清除這次執行中同意過的金鑰.
+// 傳回使用者 known_hosts 的路徑.
+func useKnownHosts(t *testing.T, content string) string {
+	t.Helper()
+
+	dir := t.TempDir()
+	userFile := filepath.Join(dir, "known_hosts")
+	if content != "" {
+		if err := os.WriteFile(userFile, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	oldUser, oldGlobal := userKnownHostsFile, globalKnownHostsFile
+	t.Cleanup(func() {
+		userKnownHostsFile, globalKnownHostsFile = oldUser, oldGlobal
+		trustedHostKeys.m = nil
+	})
+	userKnownHostsFile, globalKnownHostsFile = userFile, filepath.Join(dir, "missing")
+	trustedHostKeys.m = nil
+
+	return userFile
+}
+
+// useAskpassAnswer 讓詢問使用者的提示由 SSH_ASKPASS 回答 answer
+func useAskpassAnswer(t *testing.T, answer string) {
+	t.Helper()
+
+	if runtime.GOOS == "windows" {
+		t.Skip("SSH_ASKPASS 的測試需要 /bin/sh")
+	}
+	script := filepath.Join(t.TempDir(), "askpass")
+	if err := os.WriteFile(script, []byte("#!/bin/sh\necho "+answer+"\n"), 0o700); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("SSH_ASKPASS", script)
+	t.Setenv("SSH_ASKPASS_REQUIRE", "force")
+}
+
+func newHostKey(t *testing.T) ssh.PublicKey {
+	t.Helper()
+
+	signer, err := ssh.NewSignerFromKey(newEd25519Key(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return signer.PublicKey()
+}
+
+func knownHostsLine(pattern string, key ssh.PublicKey) string {
+	return pattern + " " + string(ssh.MarshalAuthorizedKey(key))
+}
+
+func TestHostKeyChecker(t *testing.T) {
+	const host = "web.example.com:22"
+	remote := &net.TCPAddr{IP: net.IPv4(10, 0, 0, 5), Port: 22}
+	known, other := newHostKey(t), newHostKey(t)
+
+	recorded := knownHostsLine("web.example.com", known)
+	hashed := knownHostsLine(knownhosts.HashHostname("web.example.com"), known)
+	revoked := knownHostsLine("@revoked *", other)
+
+	tests := []struct {
+		name       string
+		mode       string
+		knownHosts string
+		askpass    string // 詢問使用者時的回答, 空字串表示不會詢問
+		key        ssh.PublicKey
+		wantErr    string
+		wantAdded  bool // 金鑰是否加入使用者的 known_hosts
+	}{
+		{name: "已知主機", mode: HostKeyCheckYes, knownHosts: recorded, key: known},
+		{name: "雜湊的主機名稱", mode: HostKeyCheckYes, knownHosts: hashed, key: known},
+		{name: "未知主機 yes", mode: HostKeyCheckYes, key: known, wantErr: "不在 known_hosts 中"},
+		{name: "未知主機 accept-new", mode: HostKeyCheckAcceptNew, key: known, wantAdded: true},
+		{name: "未知主機 no", mode: HostKeyCheckNo, key: known, wantAdded: true},
+		{name: "未知主機 ask 同意", mode: HostKeyCheckAsk, askpass: "yes", key: known, wantAdded: true},
+		{name: "未知主機 ask 拒絕", mode: HostKeyCheckAsk, askpass: "no", key: known, wantErr: "使用者拒絕"},
+		{name: "金鑰變更 yes", mode: HostKeyCheckYes, knownHosts: recorded, key: other, wantErr: "金鑰已經變更"},
+		{name: "金鑰變更 accept-new", mode: HostKeyCheckAcceptNew, knownHosts: recorded, key: other, wantErr: "金鑰已經變更"},
+		{name: "金鑰變更 ask", mode: HostKeyCheckAsk, knownHosts: recorded, key: other, wantErr: "金鑰已經變更"},
+		{name: "金鑰變更 no", mode: HostKeyCheckNo, knownHosts: recorded, key: other},
+		{name: "雜湊的主機名稱金鑰變更", mode: HostKeyCheckAcceptNew, knownHosts: hashed, key: other, wantErr: "金鑰已經變更"},
+		{name: "撤銷的金鑰", mode: HostKeyCheckNo, knownHosts: revoked, key: other, wantErr: "已被撤銷"},
+		{name: "撤銷的金鑰與已知主機", mode: HostKeyCheckNo, knownHosts: recorded + revoked, key: other, wantErr: "已被撤銷"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			userFile := useKnownHosts(t, tt.knownHosts)
+			if tt.askpass != "" {
+				useAskpassAnswer(t, tt.askpass)
+			}
+
+			checker, err := newHostKeyChecker(tt.mode)
+			if err != nil {
+				t.Fatalf("newHostKeyChecker(%q) 錯誤: %v", tt.mode, err)
+			}
+			err = checker.callback(host, remote, tt.key)
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Fatalf("callback() 錯誤: %v", err)
+			case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+				t.Fatalf("callback() 錯誤 = %v, 預期包含 %q", err, tt.wantErr)
+			}
+
+			data, _ := os.ReadFile(userFile)
+			if added := string(data) != tt.knownHosts; added != tt.wantAdded {
+				t.Fatalf("known_hosts 有沒有加入金鑰 = %v, 預期 %v\n%s", added, tt.wantAdded, data)
+			}
+			if !tt.wantAdded {
+				return
+			}
+
+			// 加入的記錄同時有主機名稱與 IP 位址, 下次以 yes 檢查也會通過
+			trustedHostKeys.m = nil
+			checker, err = newHostKeyChecker(HostKeyCheckYes)
+			if err != nil {
+				t.Fatalf("newHostKeyChecker() 錯誤: %v", err)
+			}
+			for _, hostname := range []string{host, remote.String()} {
+				if err := checker.callback(hostname, remote, tt.key); err != nil {
+					t.Errorf("加入後檢查 %s 錯誤: %v", hostname, err)
+				}
+			}
+		})
+	}
+}
+
+func TestTrustedHostKeys(t *testing.T) {
+	const host = "web.example.com:22"
+	remote := &net.TCPAddr{IP: net.IPv4(10, 0, 0, 5), Port: 22}
+	known, changed, other := newHostKey(t), newHostKey(t), newHostKey(t)
+
+	tests := []struct {
+		name       string
+		mode       string // 第一次連線的模式
+		knownHosts string
+		askpass    string
+		key        ssh.PublicKey
+	}{
+		{name: "金鑰變更只警告", mode: HostKeyCheckNo, knownHosts: knownHostsLine("web.example.com", known), key: changed},
+		{name: "使用者同意", mode: HostKeyCheckAsk, askpass: "yes", key: known},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			userFile := useKnownHosts(t, tt.knownHosts)
+			if tt.askpass != "" {
+				useAskpassAnswer(t, tt.askpass)
+			}
+
+			checker, err := newHostKeyChecker(tt.mode)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := checker.callback(host, remote, tt.key); err != nil {
+				t.Fatalf("第一次連線錯誤: %v", err)
+			}
+
+			// 重新連線時會建立新的 checker. 讓 known_hosts 消失, 使用者也不再同意, 同意過的金鑰仍然有效
+			os.Remove(userFile)
+			if tt.askpass != "" {
+				useAskpassAnswer(t, "no")
+			}
+			checker, err = newHostKeyChecker(HostKeyCheckYes)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := checker.callback(host, remote, tt.key); err != nil {
+				t.Errorf("重新連線錯誤: %v", err)
+			}
+			if err := checker.callback("db.example.com:22", remote, tt.key); err == nil {
+				t.Error("其他主機使用同一把金鑰時沒有錯誤")
+			}
+			if err := checker.callback(host, remote, other); err == nil {
+				t.Error("重新連線時出示其他金鑰沒有錯誤")
+			}
+		})
+	}
+}
@@ -0,0 +1,128 @@
+package transport
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/pkg/sftp"
+)
+
+// 分段傳輸的記錄檔名稱是 "." + 檔名 + journalSuffix, 與目的檔在同一個目錄. 分段不是依序完成的,
+// 程式被強制結束時目的檔中間可能有還沒寫入的部分, 續傳時只能信任記錄檔中從開頭起連續完成的長度.
+const journalSuffix = ".scopy-journal"
+
+// localJournalPath 傳回本地目的檔 localPath 的分段記錄檔
+func localJournalPath(localPath string) string {
+	return filepath.Join(filepath.Dir(localPath), "."+filepath.Base(localPath)+journalSuffix)
+}
+
+// remoteJournalPath 傳回遠端目的檔 remotePath 的分段記錄檔
+func remoteJournalPath(remotePath string, remoteSep string) string {
+	idx := strings.LastIndex(remotePath, remoteSep)
+	return remotePath[:idx+1] + "." + remotePath[idx+1:] + journalSuffix
+}
+
+// parseJournal 解析記錄檔的內容. 內容不正確 (如寫到一半被中止) 時視為沒有可信任的部分.
+func parseJournal(data []byte) int64 {
+	prefix, err := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+	if err != nil || prefix < 0 {
+		return 0
+	}
+
+	return prefix
+}
+
+// readLocalJournal 讀取本地的分段記錄檔, 沒有記錄檔時 ok 為 false
+func readLocalJournal(path string) (prefix int64, ok bool) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, false
+	}
+
+	return parseJournal(data), true
+}
+
+// readRemoteJournal 讀取遠端的分段記錄檔, 沒有記錄檔時 ok 為 false
+func readRemoteJournal(client *sftp.Client, path string) (prefix int64, ok bool) {
+	file, err := client.Open(path)
+	if err != nil {
+		return 0, false
+	}
+	defer file.Close()
+
+	data, err := io.ReadAll(file)
+	if err != nil {
+		return 0, true
+	}
+
+	return parseJournal(data), true
+}
+
+// writeLocalJournal 寫入本地的分段記錄檔
+func writeLocalJournal(path string, prefix int64) error {
+	return os.WriteFile(path, []byte(strconv.FormatInt(prefix, 10)), 0o644)
+}
+
+// writeRemoteJournal 寫入遠端的分段記錄檔
+func writeRemoteJournal(remote *Remote, path string, prefix int64) error {
+	return remote.retry(func(client *sftp.Client) error {
+		file, err := client.Create(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+
+		_, err = file.Write([]byte(strconv.FormatInt(prefix, 10)))
+		return err
+	})
+}
+
+// chunkJournal 在分段傳輸中記錄從檔案開頭起連續完成的位元組數. 只在連續完成的部分變長時寫入,
+// 寫入失敗時記錄只會落後, 續傳時多複製一些, 不會信任還沒寫入的部分.
+type chunkJournal struct {
+	mu       sync.Mutex
+	chunks   []*chunk
+	complete []bool
+	prefix   int64
+	save     func(prefix int64) error
+}
+
+// newChunkJournal 在開始傳輸 chunks 前寫入記錄, from 之前的部分已經複製過.
+// 無法寫入時傳回錯誤, 沒有記錄的分段傳輸被中止後無法安全地續傳.
+func newChunkJournal(chunks []*chunk, from int64, save func(prefix int64) error) (*chunkJournal, error) {
+	j := &chunkJournal{chunks: chunks, complete: make([]bool, len(chunks)), prefix: from, save: save}
+	for idx, c := range chunks {
+		j.complete[idx] = c.done == c.length
+	}
+
+	if err := save(from); err != nil {
+		return nil, err
+	}
+
+	return j, nil
+}
+
+// done 記錄第 idx 個分段已經完成. 分段的 done 由其他 goroutine 修改, 所以這裡只看完成的分段.
+func (j *chunkJournal) done(idx int) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	j.complete[idx] = true
+	prefix := j.prefix
+	for i, c := range j.chunks {
+		if !j.complete[i] {
+			break
+		}
+		prefix = max(prefix, c.offset+c.length)
+	}
+
+	if prefix > j.prefix {
+		if err := j.save(prefix); err == nil {
+			j.prefix = prefix
+		}
+	}
+}
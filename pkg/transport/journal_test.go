@@ -0,0 +1,86 @@
+package transport
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestChunkJournal(t *testing.T) {
+	tests := []struct {
+		name  string
+		from  int64
+		order []int   // 分段完成的順序
+		want  []int64 // 每次寫入記錄的長度, 第一個是開始時寫入的 from
+	}{
+		{"依序完成", 0, []int{0, 1, 2, 3}, []int64{0, 10, 20, 30, 35}},
+		{"反序完成", 0, []int{3, 2, 1, 0}, []int64{0, 35}},
+		{"中間先完成", 0, []int{1, 0, 3, 2}, []int64{0, 20, 35}},
+		{"續傳", 15, []int{2, 1, 3}, []int64{15, 30, 35}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var saved []int64
+			chunks := splitChunks(35, 10, tt.from)
+			journal, err := newChunkJournal(chunks, tt.from, func(prefix int64) error {
+				saved = append(saved, prefix)
+				return nil
+			})
+			if err != nil {
+				t.Fatalf("newChunkJournal() 錯誤: %v", err)
+			}
+
+			for _, idx := range tt.order {
+				journal.done(idx)
+			}
+			if !slices.Equal(saved, tt.want) {
+				t.Errorf("寫入的記錄 = %v, 預期 %v (分段 %v)", saved, tt.want, chunkRanges(chunks))
+			}
+		})
+	}
+}
+
+func chunkRanges(chunks []*chunk) [][2]int64 {
+	var ranges [][2]int64
+	for _, c := range chunks {
+		ranges = append(ranges, [2]int64{c.offset, c.offset + c.length})
+	}
+	return ranges
+}
+
+func TestParseJournal(t *testing.T) {
+	tests := []struct {
+		data string
+		want int64
+	}{
+		{"8388608", 8388608},
+		{"42\n", 42},
+		{"", 0},
+		{"-1", 0},
+		{"garbage", 0},
+	}
+
+	for _, tt := range tests {
+		if got := parseJournal([]byte(tt.data)); got != tt.want {
+			t.Errorf("parseJournal(%q) = %d, 預期 %d", tt.data, got, tt.want)
+		}
+	}
+}
+
+func TestRemoteJournalPath(t *testing.T) {
+	tests := []struct {
+		path string
+		sep  string
+		want string
+	}{
+		{"/data/big.iso", "/", "/data/.big.iso.scopy-journal"},
+		{"big.iso", "/", ".big.iso.scopy-journal"},
+		{`C:\data\big.iso`, `\`, `C:\data\.big.iso.scopy-journal`},
+	}
+
+	for _, tt := range tests {
+		if got := remoteJournalPath(tt.path, tt.sep); got != tt.want {
+			t.Errorf("remoteJournalPath(%q) = %q, 預期 %q", tt.path, got, tt.want)
+		}
+	}
+}
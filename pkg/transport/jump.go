@@ -0,0 +1,94 @@
+package transport
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// jumpHost 是 ProxyJump 中的一台跳板主機
+type jumpHost struct {
+	Username string
+	Host     string
+	Port     uint16
+}
+
+// parseJumpHosts 解析以逗號分隔的 [user@]host[:port] 或 ssh://[user@]host[:port]
+func parseJumpHosts(spec string) ([]jumpHost, error) {
+	var hops []jumpHost
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimPrefix(strings.TrimSpace(part), "ssh://")
+		if part == "" {
+			return nil, fmt.Errorf("跳板主機設定不正確: %q", spec)
+		}
+
+		hop := jumpHost{}
+		if idx := strings.LastIndex(part, "@"); idx >= 0 {
+			hop.Username = part[:idx]
+			part = part[idx+1:]
+		}
+
+		hop.Host = part
+		if host, port, err := net.SplitHostPort(part); err == nil {
+			portNum, err := strconv.ParseUint(port, 10, 16)
+			if err != nil {
+				return nil, fmt.Errorf("跳板主機 %s 的埠號不正確", part)
+			}
+			hop.Host = host
+			hop.Port = uint16(portNum)
+		} else {
+			// 沒有埠號的 IPv6 位址, 如 [::1]
+			hop.Host = strings.TrimSuffix(strings.TrimPrefix(part, "["), "]")
+		}
+
+		hops = append(hops, hop)
+	}
+
+	return hops, nil
+}
+
+// connectJumpHosts 依序連線每一台跳板主機, 傳回最後一台跳板的連線.
+// 每一台跳板都會套用自己在 ssh 設定檔中的設定, 但不再處理它們的 ProxyJump.
+func connectJumpHosts(spec string, opts ConnectOptions) (*ssh.Client, error) {
+	hops, err := parseJumpHosts(spec)
+	if err != nil {
+		return nil, err
+	}
+
+	var via *ssh.Client
+	for _, hop := range hops {
+		hopOpts := opts
+		hopOpts.Username = hop.Username
+		hopOpts.Port = hop.Port
+		hopOpts.ProxyJump = "none"
+		hopOpts.ForwardAgent = false
+
+		host, hopOpts, err := applyHostConfig(hop.Host, hopOpts)
+		if err != nil {
+			return nil, err
+		}
+
+		printf("經由跳板主機 %s\n", hop.Host)
+		client, err := connect(host, hopOpts, via)
+		if err != nil {
+			if via != nil {
+				via.Close()
+			}
+			return nil, fmt.Errorf("連線至跳板主機 %s: %w", hop.Host, err)
+		}
+
+		if via != nil {
+			prev := via
+			go func() {
+				client.Wait()
+				prev.Close()
+			}()
+		}
+		via = client
+	}
+
+	return via, nil
+}
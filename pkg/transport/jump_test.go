@@ -0,0 +1,44 @@
+package transport
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseJumpHosts(t *testing.T) {
+	tests := []struct {
+		spec    string
+		want    []jumpHost
+		wantErr bool
+	}{
+		{spec: "bastion", want: []jumpHost{{Host: "bastion"}}},
+		{spec: "user@bastion:2222", want: []jumpHost{{Username: "user", Host: "bastion", Port: 2222}}},
+		{spec: "ssh://user@bastion:22", want: []jumpHost{{Username: "user", Host: "bastion", Port: 22}}},
+		{spec: "a@one, two:2200", want: []jumpHost{{Username: "a", Host: "one"}, {Host: "two", Port: 2200}}},
+		{spec: "user@mail.com@bastion", want: []jumpHost{{Username: "user@mail.com", Host: "bastion"}}},
+		{spec: "[::1]:2222", want: []jumpHost{{Host: "::1", Port: 2222}}},
+		{spec: "root@[fe80::1]", want: []jumpHost{{Username: "root", Host: "fe80::1"}}},
+		{spec: "", wantErr: true},
+		{spec: "one,,two", wantErr: true},
+		{spec: "bastion:ssh", wantErr: true},
+		{spec: "bastion:70000", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.spec, func(t *testing.T) {
+			got, err := parseJumpHosts(tt.spec)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("parseJumpHosts(%q) = %+v, 預期錯誤", tt.spec, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseJumpHosts(%q) 錯誤: %v", tt.spec, err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseJumpHosts(%q) = %+v, 預期 %+v", tt.spec, got, tt.want)
+			}
+		})
+	}
+}
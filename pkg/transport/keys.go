@@ -0,0 +1,245 @@
+package transport
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// 私鑰密碼最多輸入的次數
+const maxPassphraseTries = 3
+
+// passphrases 記錄這次執行中輸入過的私鑰密碼. 多把私鑰常用同一個密碼, 先試過這些再詢問使用者.
+var passphrases struct {
+	sync.Mutex
+	list [][]byte
+}
+
+// addPassphrase 將密碼加入這次執行中嘗試的私鑰密碼
+func addPassphrase(passphrase []byte) {
+	passphrases.Lock()
+	defer passphrases.Unlock()
+
+	for _, known := range passphrases.list {
+		if bytes.Equal(known, passphrase) {
+			return
+		}
+	}
+	passphrases.list = append(passphrases.list, passphrase)
+}
+
+// errKeySkipped 使用者選擇不解開私鑰
+var errKeySkipped = errors.New("略過私鑰")
+
+// loadKeySigners 載入所有候選的私鑰. 不存在的私鑰直接略過, 無法讀取或解析的私鑰顯示警告後略過.
+// 有密碼保護的私鑰放在最後, 而且要等伺服器接受它的公鑰後才詢問密碼.
+func loadKeySigners(keys []string, tracker *identityTracker) []ssh.Signer {
+	var (
+		plain, encrypted []ssh.Signer
+		loaded           []string
+	)
+	for _, key := range keys {
+		path, err := expandPath(key)
+		if err != nil || slices.Contains(loaded, path) {
+			continue
+		}
+		loaded = append(loaded, path)
+
+		signer, err := loadKeyFile(path)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			eprintf("[警告] 略過私鑰 %s: %v\n", path, err)
+			continue
+		}
+
+		if _, ok := signer.(*lazySigner); ok {
+			encrypted = append(encrypted, withName(signer, path, tracker))
+		} else {
+			plain = append(plain, withName(signer, path, tracker))
+		}
+	}
+
+	return append(plain, encrypted...)
+}
+
+// loadKeyFile 從檔案路徑建立 ssh.Signer
+func loadKeyFile(path string) (ssh.Signer, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	// 嘗試解析不帶密碼保護的私鑰
+	signer, err := ssh.ParsePrivateKey(buf)
+	if err == nil {
+		return signer, nil
+	}
+
+	var missing *ssh.PassphraseMissingError
+	if !errors.As(err, &missing) {
+		return nil, fmt.Errorf("無法解析私鑰: %w", err)
+	}
+
+	lazy := &lazySigner{path: path, pem: buf, pub: missing.PublicKey}
+	if lazy.pub == nil {
+		// 舊的 PEM 格式不含公鑰, 改讀旁邊的 .pub
+		if pubBuf, err := os.ReadFile(path + ".pub"); err == nil {
+			if pub, _, _, _, err := ssh.ParseAuthorizedKey(pubBuf); err == nil {
+				lazy.pub = pub
+			}
+		}
+	}
+	if lazy.pub == nil {
+		// 沒辦法知道公鑰, 只好現在就解開
+		if err := lazy.unlock(); err != nil {
+			return nil, err
+		}
+		return lazy.signer, nil
+	}
+
+	return lazy, nil
+}
+
+// lazySigner 是有密碼保護的私鑰. 只有在伺服器接受它的公鑰, 真的需要簽章時才詢問密碼.
+type lazySigner struct {
+	path   string
+	pem    []byte
+	pub    ssh.PublicKey
+	signer ssh.AlgorithmSigner
+	err    error
+}
+
+func (s *lazySigner) PublicKey() ssh.PublicKey {
+	return s.pub
+}
+
+func (s *lazySigner) Sign(rand io.Reader, data []byte) (*ssh.Signature, error) {
+	return s.SignWithAlgorithm(rand, data, "")
+}
+
+func (s *lazySigner) SignWithAlgorithm(rand io.Reader, data []byte, algorithm string) (*ssh.Signature, error) {
+	if err := s.unlock(); err != nil {
+		return nil, err
+	}
+
+	return s.signer.SignWithAlgorithm(rand, data, algorithm)
+}
+
+// unlock 解開私鑰, 先試這次執行中輸入過的密碼, 都不對才詢問使用者
+func (s *lazySigner) unlock() error {
+	if s.signer != nil || s.err != nil {
+		return s.err
+	}
+
+	passphrases.Lock()
+	defer passphrases.Unlock()
+
+	for _, passphrase := range passphrases.list {
+		if s.parse(passphrase) == nil {
+			return nil
+		}
+	}
+
+	for try := 0; try < maxPassphraseTries; try++ {
+		passphrase, err := readPassword(fmt.Sprintf("輸入私鑰 %s 的密碼 (直接按 Enter 略過): ", s.path))
+		if err != nil {
+			s.err = fmt.Errorf("私鑰密碼輸入失敗: %w", err)
+			return s.err
+		}
+		if passphrase == "" {
+			s.err = errKeySkipped
+			return s.err
+		}
+
+		if err := s.parse([]byte(passphrase)); err == nil {
+			passphrases.list = append(passphrases.list, []byte(passphrase))
+			return nil
+		}
+		eprintf("密碼錯誤.\n")
+	}
+
+	s.err = fmt.Errorf("無法解開私鑰 %s", s.path)
+	return s.err
+}
+
+func (s *lazySigner) parse(passphrase []byte) error {
+	signer, err := ssh.ParsePrivateKeyWithPassphrase(s.pem, passphrase)
+	if err != nil {
+		return err
+	}
+
+	algorithmSigner, ok := signer.(ssh.AlgorithmSigner)
+	if !ok {
+		return fmt.Errorf("不支援的私鑰類型 %s", signer.PublicKey().Type())
+	}
+	s.signer = algorithmSigner
+
+	return nil
+}
+
+// identityTracker 記錄最後使用的身分 (簽章成功的私鑰, 或是密碼), 連線成功後就是認證成功的那一個
+type identityTracker struct {
+	last     string
+	password string // 最後一次從終端機輸入的密碼
+}
+
+// namedSigner 為 signer 加上名稱 (私鑰路徑或 ssh-agent 中的註解), 簽章時記錄到 tracker
+type namedSigner struct {
+	ssh.AlgorithmSigner
+	name    string
+	tracker *identityTracker
+}
+
+func (s *namedSigner) Sign(rand io.Reader, data []byte) (*ssh.Signature, error) {
+	return s.SignWithAlgorithm(rand, data, "")
+}
+
+func (s *namedSigner) SignWithAlgorithm(rand io.Reader, data []byte, algorithm string) (*ssh.Signature, error) {
+	signature, err := s.AlgorithmSigner.SignWithAlgorithm(rand, data, algorithm)
+	if err == nil {
+		s.tracker.last = s.name
+	}
+
+	return signature, err
+}
+
+// withName 將 signer 包裝成 namedSigner, 並保留原本支援的簽章演算法
+func withName(signer ssh.Signer, name string, tracker *identityTracker) ssh.Signer {
+	algorithmSigner, ok := signer.(ssh.AlgorithmSigner)
+	if !ok {
+		return signer
+	}
+
+	named := &namedSigner{AlgorithmSigner: algorithmSigner, name: name, tracker: tracker}
+	if multi, ok := signer.(ssh.MultiAlgorithmSigner); ok {
+		if restricted, err := ssh.NewSignerWithAlgorithms(named, multi.Algorithms()); err == nil {
+			return restricted
+		}
+	}
+
+	return named
+}
+
+// defaultKeys 傳回 ~/.ssh 下所有存在的預設私鑰
+func defaultKeys() []string {
+	var keys []string
+	for _, key := range defaultPrivateKeys {
+		path, err := expandPath(key)
+		if err != nil {
+			continue
+		}
+
+		if _, err := os.Stat(path); err == nil && !slices.Contains(keys, path) {
+			keys = append(keys, path)
+		}
+	}
+
+	return keys
+}
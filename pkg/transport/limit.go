@@ -0,0 +1,107 @@
+package transport
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// rateLimiter 以權杖桶 (token bucket) 限制傳輸速度. 同一次複製中所有的檔案與分段共用一個,
+// 所以限制的是整體的速度. nil 表示不限制, 所有的方法都可以用在 nil 上.
+type rateLimiter struct {
+	mu     sync.Mutex
+	rate   float64 // 每秒補充的權杖數, 一個權杖是一個位元組
+	burst  float64 // 桶的容量, 閒置後最多可以一次傳輸的位元組數
+	tokens float64 // 可以是負的, 表示已經預支, 之後的傳輸要等到補回來
+	last   time.Time
+}
+
+// newRateLimiter 建立每秒 bytesPerSec 位元組的限制, 小於等於 0 時傳回 nil
+func newRateLimiter(bytesPerSec int64) *rateLimiter {
+	if bytesPerSec <= 0 {
+		return nil
+	}
+
+	rate := float64(bytesPerSec)
+	// 容量太小時 SFTP 的每個封包都要等待, 太大時一開始會超過限制太多
+	burst := min(max(rate/4, 32<<10), rate)
+
+	return &rateLimiter{rate: rate, burst: burst, tokens: burst, last: time.Now()}
+}
+
+// wait 取得 n 個權杖, 不夠時先預支, 再等待到補回來為止. 不在持有鎖的時候等待, 其他的傳輸可以同時預支.
+func (l *rateLimiter) wait(n int) {
+	if l == nil || n <= 0 {
+		return
+	}
+
+	l.mu.Lock()
+	now := time.Now()
+	l.tokens = min(l.tokens+now.Sub(l.last).Seconds()*l.rate, l.burst)
+	l.last = now
+	l.tokens -= float64(n)
+	delay := time.Duration(-l.tokens / l.rate * float64(time.Second))
+	l.mu.Unlock()
+
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+}
+
+// reader 包裝 r, 讀取後等待權杖
+func (l *rateLimiter) reader(r io.Reader) io.Reader {
+	if l == nil {
+		return r
+	}
+
+	return &limitedReader{r: r, limiter: l}
+}
+
+// writer 包裝 w, 寫入前等待權杖
+func (l *rateLimiter) writer(w io.Writer) io.Writer {
+	if l == nil {
+		return w
+	}
+
+	return &limitedWriter{w: w, limiter: l}
+}
+
+// writerAt 包裝 w, 寫入前等待權杖
+func (l *rateLimiter) writerAt(w io.WriterAt) io.WriterAt {
+	if l == nil {
+		return w
+	}
+
+	return &limitedWriterAt{w: w, limiter: l}
+}
+
+type limitedReader struct {
+	r       io.Reader
+	limiter *rateLimiter
+}
+
+func (r *limitedReader) Read(b []byte) (int, error) {
+	n, err := r.r.Read(b)
+	r.limiter.wait(n)
+	return n, err
+}
+
+type limitedWriter struct {
+	w       io.Writer
+	limiter *rateLimiter
+}
+
+func (w *limitedWriter) Write(b []byte) (int, error) {
+	w.limiter.wait(len(b))
+	return w.w.Write(b)
+}
+
+type limitedWriterAt struct {
+	w       io.WriterAt
+	limiter *rateLimiter
+}
+
+func (w *limitedWriterAt) WriteAt(b []byte, offset int64) (int, error) {
+	w.limiter.wait(len(b))
+	return w.w.WriteAt(b, offset)
+}
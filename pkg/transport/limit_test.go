@@ -0,0 +1,73 @@
+package transport
+
+import (
+	"bytes"
+	"io"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestNewRateLimiter(t *testing.T) {
+	tests := []struct {
+		rate      int64
+		wantNil   bool
+		wantBurst float64
+	}{
+		{rate: 0, wantNil: true},
+		{rate: -1, wantNil: true},
+		{rate: 10 << 10, wantBurst: 10 << 10},  // 容量不超過一秒的量
+		{rate: 64 << 10, wantBurst: 32 << 10},  // 最少 32 KiB
+		{rate: 100 << 20, wantBurst: 25 << 20}, // 四分之一秒的量
+	}
+
+	for _, tt := range tests {
+		l := newRateLimiter(tt.rate)
+		if (l == nil) != tt.wantNil {
+			t.Errorf("newRateLimiter(%d) = %v, 預期 nil %v", tt.rate, l, tt.wantNil)
+			continue
+		}
+		if l != nil && (l.burst != tt.wantBurst || l.tokens != tt.wantBurst) {
+			t.Errorf("newRateLimiter(%d) 容量 %.0f, 權杖 %.0f, 預期都是 %.0f", tt.rate, l.burst, l.tokens, tt.wantBurst)
+		}
+	}
+
+	// 不限制時直接使用原本的 Reader 與 Writer
+	var l *rateLimiter
+	var buf bytes.Buffer
+	if l.reader(&buf) != io.Reader(&buf) || l.writer(&buf) != io.Writer(&buf) {
+		t.Error("nil 的 rateLimiter 包裝了 Reader 或 Writer")
+	}
+	l.wait(1 << 30)
+}
+
+func TestRateLimiterShared(t *testing.T) {
+	const (
+		rate    = 4 << 20 // 容量是 1 MiB
+		streams = 4
+		size    = 768 << 10
+	)
+
+	// 同時傳輸的資料共用一個限制: 3 MiB 扣掉一開始的 1 MiB 容量, 以每秒 4 MiB 需要 0.5 秒
+	l := newRateLimiter(rate)
+	data := make([]byte, size)
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := range streams {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if i%2 == 0 {
+				io.Copy(io.Discard, l.reader(bytes.NewReader(data)))
+			} else {
+				io.Copy(l.writer(io.Discard), bytes.NewReader(data))
+			}
+		}()
+	}
+	wg.Wait()
+
+	want := time.Duration(float64(streams*size-l.burst) / rate * float64(time.Second))
+	if elapsed := time.Since(start); elapsed < want*9/10 || elapsed > want*2 {
+		t.Errorf("傳輸 %d 位元組花了 %s, 預期約 %s", streams*size, elapsed, want)
+	}
+}
@@ -0,0 +1,248 @@
+package transport
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"scopy/pkg/util"
+
+	"github.com/pkg/sftp"
+)
+
+// mirror 記錄來源的每個目錄中有哪些項目, 複製完成後據此刪除目的地多出來的項目. 路徑都是相對於來源的根目錄.
+type mirror struct {
+	dirs    []string
+	entries map[string]map[string]bool
+}
+
+func newMirror() *mirror {
+	return &mirror{entries: make(map[string]map[string]bool)}
+}
+
+// add 記錄來源中的 relPath
+func (m *mirror) add(relPath string, isDir bool) {
+	if relPath != "." {
+		parent, name := filepath.Dir(relPath), filepath.Base(relPath)
+		if m.entries[parent] == nil {
+			m.entries[parent] = make(map[string]bool)
+		}
+		m.entries[parent][name] = true
+	}
+
+	if isDir {
+		m.dirs = append(m.dirs, relPath)
+	}
+}
+
+// extraneous 從目的目錄 relDir 的項目 names 中找出來源沒有的項目. 符合排除規則的項目與暫存檔不算在內,
+// 多出來的目錄之下符合排除規則的項目則由刪除的一方保留.
+func (m *mirror) extraneous(relDir string, names []string, excludes []string) []string {
+	var extra []string
+	for _, name := range names {
+		if m.entries[relDir][name] || isPartialName(name) || isMatched(filepath.Join(relDir, name), excludes) {
+			continue
+		}
+		extra = append(extra, name)
+	}
+	slices.Sort(extra)
+
+	return extra
+}
+
+// deletion 是要刪除的項目, 目錄排在它的內容之前
+type deletion struct {
+	path  string
+	isDir bool
+}
+
+// confirmDeletions 檢查刪除的數量是否超過 opts.MaxDelete, 超過時一個也不刪除
+func confirmDeletions(deletions []deletion, opts TransferOptions) error {
+	if opts.MaxDelete > 0 && len(deletions) > opts.MaxDelete {
+		return fmt.Errorf("需要刪除 %d 個項目, 超過上限 %d, 沒有刪除任何項目", len(deletions), opts.MaxDelete)
+	}
+
+	return nil
+}
+
+// deleteLocalExtraneous 刪除本地目錄 localRoot 中來源沒有的項目
+func deleteLocalExtraneous(localRoot string, m *mirror, opts TransferOptions) error {
+	var deletions []deletion
+	var protected []string
+	for _, relDir := range m.dirs {
+		dir := filepath.Join(localRoot, relDir)
+		entries, err := os.ReadDir(dir)
+		if os.IsNotExist(err) && opts.DryRun {
+			// 模擬時還沒有建立的目錄
+			continue
+		} else if err != nil {
+			return fmt.Errorf("讀取本地目錄 (%s): %w", dir, err)
+		}
+
+		var names []string
+		for _, entry := range entries {
+			names = append(names, entry.Name())
+		}
+		for _, name := range m.extraneous(relDir, names, opts.Excludes) {
+			// WalkDir 不會進入符號連結指向的目錄
+			if err := filepath.WalkDir(filepath.Join(dir, name), func(path string, entry fs.DirEntry, err error) error {
+				if err != nil {
+					return err
+				}
+				relPath, err := filepath.Rel(localRoot, path)
+				if err != nil {
+					return err
+				}
+				if isMatched(relPath, opts.Excludes) {
+					protected = append(protected, path)
+					if entry.IsDir() {
+						return fs.SkipDir
+					}
+					return nil
+				}
+				deletions = append(deletions, deletion{path: path, isDir: entry.IsDir()})
+				return nil
+			}); err != nil {
+				return fmt.Errorf("掃描要刪除的本地項目: %w", err)
+			}
+		}
+	}
+	deletions = keepProtectedParents(deletions, protected, string(filepath.Separator))
+
+	if err := confirmDeletions(deletions, opts); err != nil {
+		return err
+	}
+
+	if opts.DeleteDryRun || opts.DryRun {
+		for _, d := range deletions {
+			opts.printf("將刪除本地%s %s\n", kindName(d.isDir), d.path)
+		}
+		return nil
+	}
+
+	// 先刪除目錄的內容再刪除目錄
+	for _, d := range slices.Backward(deletions) {
+		printf("刪除本地%s %s\n", kindName(d.isDir), d.path)
+		if err := os.Remove(d.path); err != nil {
+			return fmt.Errorf("刪除本地%s: %w", kindName(d.isDir), err)
+		}
+	}
+
+	return nil
+}
+
+// deleteRemoteExtraneous 刪除遠端目錄 remoteRoot 中來源沒有的項目
+func deleteRemoteExtraneous(remote *Remote, remoteRoot string, m *mirror, opts TransferOptions) error {
+	sep := remote.Sep()
+	join := func(dir string, name string) string {
+		return strings.TrimSuffix(dir, sep) + sep + name
+	}
+
+	var deletions []deletion
+	var protected []string
+	// collect 記錄 path 以及其下所有不符合排除規則的項目, relPath 是 path 相對於 remoteRoot 的路徑.
+	// ReadDir 傳回的是符號連結本身的資訊, 所以不會進入它指向的目錄.
+	var collect func(path string, relPath string, info os.FileInfo) error
+	collect = func(path string, relPath string, info os.FileInfo) error {
+		if isMatched(relPath, opts.Excludes) {
+			protected = append(protected, path)
+			return nil
+		}
+		deletions = append(deletions, deletion{path: path, isDir: info.IsDir()})
+		if !info.IsDir() {
+			return nil
+		}
+
+		var entries []os.FileInfo
+		if err := remote.retry(func(client *sftp.Client) (err error) {
+			entries, err = client.ReadDir(path)
+			return err
+		}); err != nil {
+			return fmt.Errorf("讀取遠端目錄 (%s): %w", path, err)
+		}
+		for _, entry := range entries {
+			if err := collect(join(path, entry.Name()), filepath.Join(relPath, entry.Name()), entry); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	for _, relDir := range m.dirs {
+		dir := util.ReplaceSepWith(filepath.Join(remoteRoot, relDir), sep)
+
+		var entries []os.FileInfo
+		if err := remote.retry(func(client *sftp.Client) (err error) {
+			entries, err = client.ReadDir(dir)
+			if os.IsNotExist(err) && opts.DryRun {
+				// 模擬時還沒有建立的目錄
+				return nil
+			}
+			return err
+		}); err != nil {
+			return fmt.Errorf("讀取遠端目錄 (%s): %w", dir, err)
+		}
+
+		infos := make(map[string]os.FileInfo)
+		var names []string
+		for _, entry := range entries {
+			infos[entry.Name()] = entry
+			names = append(names, entry.Name())
+		}
+		for _, name := range m.extraneous(relDir, names, opts.Excludes) {
+			if err := collect(join(dir, name), filepath.Join(relDir, name), infos[name]); err != nil {
+				return err
+			}
+		}
+	}
+	deletions = keepProtectedParents(deletions, protected, sep)
+
+	if err := confirmDeletions(deletions, opts); err != nil {
+		return err
+	}
+
+	if opts.DeleteDryRun || opts.DryRun {
+		for _, d := range deletions {
+			opts.printf("將刪除遠端%s %s\n", kindName(d.isDir), d.path)
+		}
+		return nil
+	}
+
+	for _, d := range slices.Backward(deletions) {
+		printf("刪除遠端%s %s\n", kindName(d.isDir), d.path)
+		if err := remote.retry(func(client *sftp.Client) error {
+			err := client.Remove(d.path)
+			if os.IsNotExist(err) {
+				// 重新連線前其實已經刪除了
+				return nil
+			}
+			return err
+		}); err != nil {
+			return fmt.Errorf("刪除遠端%s: %w", kindName(d.isDir), err)
+		}
+	}
+
+	return nil
+}
+
+// keepProtectedParents 從 deletions 移除還有受保護項目 (符合排除規則) 的目錄, 這些項目與它們所在的目錄都要保留
+func keepProtectedParents(deletions []deletion, protected []string, sep string) []deletion {
+	return slices.DeleteFunc(deletions, func(d deletion) bool {
+		prefix := strings.TrimSuffix(d.path, sep) + sep
+		return d.isDir && slices.ContainsFunc(protected, func(path string) bool {
+			return strings.HasPrefix(path, prefix)
+		})
+	})
+}
+
+func kindName(isDir bool) string {
+	if isDir {
+		return "目錄"
+	}
+
+	return "檔案"
+}
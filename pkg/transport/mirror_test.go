@@ -0,0 +1,196 @@
+package transport
+
+import (
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/pkg/sftp"
+)
+
+// newTestRemote 傳回經由記憶體中的 SFTP 伺服器存取本地檔案系統的 Remote. 沒有 SSH 連線, 所以不能重新連線.
+func newTestRemote(t *testing.T) *Remote {
+	t.Helper()
+
+	clientR, serverW := io.Pipe()
+	serverR, clientW := io.Pipe()
+	server, err := sftp.NewServer(struct {
+		io.Reader
+		io.WriteCloser
+	}{serverR, serverW})
+	if err != nil {
+		t.Fatalf("建立 SFTP 伺服器: %v", err)
+	}
+	go server.Serve()
+
+	client, err := sftp.NewClientPipe(clientR, clientW)
+	if err != nil {
+		t.Fatalf("建立 SFTP 客戶端: %v", err)
+	}
+	t.Cleanup(func() {
+		// 先關閉伺服器一端的輸出, 客戶端才會結束讀取
+		server.Close()
+		client.Close()
+	})
+
+	return &Remote{client: client, sep: "/"}
+}
+
+// makeTree 在 root 之下建立 paths, 以 / 結尾的是目錄
+func makeTree(t *testing.T, root string, paths ...string) {
+	t.Helper()
+
+	for _, path := range paths {
+		isDir := strings.HasSuffix(path, "/")
+		path = filepath.Join(root, filepath.FromSlash(path))
+		if isDir {
+			if err := os.MkdirAll(path, 0o755); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(path), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// listTree 傳回 root 之下所有的項目, 以 / 分隔, 目錄以 / 結尾
+func listTree(t *testing.T, root string) []string {
+	t.Helper()
+
+	var paths []string
+	err := filepath.WalkDir(root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || path == root {
+			return err
+		}
+		relPath, _ := filepath.Rel(root, path)
+		relPath = filepath.ToSlash(relPath)
+		if entry.IsDir() {
+			relPath += "/"
+		}
+		paths = append(paths, relPath)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	slices.Sort(paths)
+
+	return paths
+}
+
+func TestDeleteExtraneous(t *testing.T) {
+	deleters := map[string]func(t *testing.T, root string, m *mirror, opts TransferOptions) error{
+		"本地": func(t *testing.T, root string, m *mirror, opts TransferOptions) error {
+			return deleteLocalExtraneous(root, m, opts)
+		},
+		"遠端": func(t *testing.T, root string, m *mirror, opts TransferOptions) error {
+			return deleteRemoteExtraneous(newTestRemote(t), filepath.ToSlash(root), m, opts)
+		},
+	}
+
+	tests := []struct {
+		name     string
+		source   []string // 來源的項目, 以 / 結尾的是目錄
+		dest     []string
+		excludes []string
+		want     []string
+	}{
+		{
+			name:   "刪除多餘的檔案與目錄",
+			source: []string{"keep.txt", "dir/"},
+			dest:   []string{"keep.txt", "old.txt", "dir/a", "gone/sub/b"},
+			want:   []string{"dir/", "keep.txt"},
+		},
+		{
+			name:     "保護排除的檔案",
+			source:   []string{"keep.txt"},
+			dest:     []string{"keep.txt", ".env", "old.txt"},
+			excludes: []string{".env"},
+			want:     []string{".env", "keep.txt"},
+		},
+		{
+			name:     "保護多餘目錄中排除的檔案",
+			source:   []string{"keep.txt"},
+			dest:     []string{"keep.txt", "olddir/.env", "olddir/a.txt", "olddir/sub/b", "gone/x"},
+			excludes: []string{".env"},
+			want:     []string{"keep.txt", "olddir/", "olddir/.env"},
+		},
+		{
+			name:     "保護多餘目錄中排除的目錄",
+			source:   []string{"app/"},
+			dest:     []string{"app/main", "old/site/uploads/img.png", "old/site/index.html"},
+			excludes: []string{"uploads"},
+			want:     []string{"app/", "old/", "old/site/", "old/site/uploads/", "old/site/uploads/img.png"},
+		},
+		{
+			name:   "保留暫存檔",
+			source: []string{"a"},
+			dest:   []string{"a", ".b.scopy-part", "b"},
+			want:   []string{".b.scopy-part", "a"},
+		},
+	}
+
+	for _, tt := range tests {
+		for side, deleteExtraneous := range deleters {
+			t.Run(tt.name+"/"+side, func(t *testing.T) {
+				root := t.TempDir()
+				makeTree(t, root, tt.dest...)
+
+				m := newMirror()
+				m.add(".", true)
+				for _, path := range tt.source {
+					m.add(filepath.FromSlash(strings.TrimSuffix(path, "/")), strings.HasSuffix(path, "/"))
+				}
+
+				opts := TransferOptions{Delete: true, Excludes: tt.excludes}
+				if err := deleteExtraneous(t, root, m, opts); err != nil {
+					t.Fatalf("刪除多餘的項目: %v", err)
+				}
+				if got := listTree(t, root); !slices.Equal(got, tt.want) {
+					t.Errorf("剩下的項目 = %v, 預期 %v", got, tt.want)
+				}
+			})
+		}
+	}
+}
+
+func TestMirrorLinkedDir(t *testing.T) {
+	copiers := map[string]func(t *testing.T, srcRoot string, dstRoot string, opts TransferOptions) error{
+		"下載": func(t *testing.T, srcRoot string, dstRoot string, opts TransferOptions) error {
+			return downloadRemoteDir(newTestRemote(t), filepath.ToSlash(srcRoot), dstRoot, opts, &transferStats{})
+		},
+		"遠端之間": func(t *testing.T, srcRoot string, dstRoot string, opts TransferOptions) error {
+			return copyRemoteDir(newTestRemote(t), filepath.ToSlash(srcRoot), newTestRemote(t), filepath.ToSlash(dstRoot), opts, &transferStats{})
+		},
+	}
+
+	for name, copyDir := range copiers {
+		t.Run(name, func(t *testing.T) {
+			srcRoot, dstRoot := t.TempDir(), t.TempDir()
+			makeTree(t, srcRoot, "real/f", "top")
+			if err := os.Symlink("real", filepath.Join(srcRoot, "linked")); err != nil {
+				t.Fatal(err)
+			}
+			makeTree(t, dstRoot, "linked/f", "real/f", "top", "extra")
+
+			if err := copyDir(t, srcRoot, dstRoot, TransferOptions{Delete: true}); err != nil {
+				t.Fatalf("複製目錄: %v", err)
+			}
+
+			// 來源中連結指向的目錄沒有走訪內容, 目的地對應目錄中的檔案不能當作多餘的項目刪除
+			want := []string{"linked/", "linked/f", "real/", "real/f", "top"}
+			if got := listTree(t, dstRoot); !slices.Equal(got, want) {
+				t.Errorf("剩下的項目 = %v, 預期 %v", got, want)
+			}
+		})
+	}
+}
@@ -55,3 +55,8 @@ func ParseScpCli(cli string) ScpInfo {
 
 	return info
 }
+
+// IsStdio 判斷路徑是否代表標準輸入或標準輸出 (本地的 "-")
+func (info ScpInfo) IsStdio() bool {
+	return info.Address == "" && info.Path == StdioPath
+}
@@ -0,0 +1,156 @@
+package transport
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"scopy/pkg/util"
+
+	"github.com/pkg/sftp"
+)
+
+// 寫入中的暫存檔名稱是 "." + 檔名 + partialSuffix, 與目的檔在同一個目錄, 完成後才改名成目的檔.
+// 名稱固定, 中斷後重新執行時可以找到它續傳.
+const partialSuffix = ".scopy-part"
+
+// isPartialName 判斷檔名是否為寫入中的暫存檔或分段記錄檔
+func isPartialName(name string) bool {
+	return strings.HasPrefix(name, ".") && (strings.HasSuffix(name, partialSuffix) || strings.HasSuffix(name, journalSuffix))
+}
+
+// localPartialPath 傳回本地檔案寫入中使用的暫存檔
+func localPartialPath(localPath string) string {
+	return filepath.Join(filepath.Dir(localPath), "."+filepath.Base(localPath)+partialSuffix)
+}
+
+// remotePartialPath 傳回遠端檔案寫入中使用的暫存檔
+func remotePartialPath(remotePath string, remoteSep string) string {
+	idx := strings.LastIndex(remotePath, remoteSep)
+	return remotePath[:idx+1] + "." + remotePath[idx+1:] + partialSuffix
+}
+
+// renameRemote 將遠端的暫存檔改名成目的檔, 目的檔已經存在時取代它.
+// SFTP 的 rename 不能覆蓋已經存在的檔案, 伺服器支援時使用 posix-rename, 否則先刪除目的檔.
+func renameRemote(client *sftp.Client, from string, to string) error {
+	if _, ok := client.HasExtension("posix-rename@openssh.com"); ok {
+		return client.PosixRename(from, to)
+	}
+
+	if err := client.Remove(to); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return client.Rename(from, to)
+}
+
+// syncRemote 要求伺服器將遠端檔案寫入磁碟. 伺服器不支援 fsync@openssh.com 時不做任何事.
+func syncRemote(client *sftp.Client, path string) error {
+	if data, ok := client.HasExtension("fsync@openssh.com"); !ok || data != "1" {
+		return nil
+	}
+
+	file, err := client.OpenFile(path, os.O_WRONLY)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	return file.Sync()
+}
+
+// finishRemote 將寫好的遠端暫存檔 target 寫入磁碟並設定修改時間與權限, 都成功後才改名成 remotePath.
+// target 就是 remotePath (直接寫入目的檔) 時不改名.
+func finishRemote(remote *Remote, target string, remotePath string, mtime time.Time, mode os.FileMode) error {
+	if err := remote.retry(func(client *sftp.Client) error {
+		return syncRemote(client, target)
+	}); err != nil {
+		return fmt.Errorf("同步遠端檔案 (%s): %w", remotePath, err)
+	}
+
+	if err := remote.retry(func(client *sftp.Client) error {
+		if err := client.Chtimes(target, mtime, mtime); err != nil {
+			return err
+		}
+		return client.Chmod(target, mode)
+	}); err != nil {
+		return fmt.Errorf("設定遠端檔案 (%s) 的屬性: %w", remotePath, err)
+	}
+
+	if target != remotePath {
+		if err := remote.retry(func(client *sftp.Client) error {
+			return renameRemote(client, target, remotePath)
+		}); err != nil {
+			return fmt.Errorf("暫存檔改名 (%s): %w", remotePath, err)
+		}
+	}
+
+	return nil
+}
+
+// cleanupLocalPartials 刪除本地目錄中上次執行中斷時留下的暫存檔
+func cleanupLocalPartials(dirs []string) {
+	for _, dir := range dirs {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			continue
+		}
+
+		for _, entry := range entries {
+			if entry.Type().IsRegular() && isPartialName(entry.Name()) {
+				path := filepath.Join(dir, entry.Name())
+				printf("刪除殘留的暫存檔 %s\n", path)
+				os.Remove(path)
+			}
+		}
+	}
+}
+
+// cleanupRemotePartials 刪除遠端目錄中上次執行中斷時留下的暫存檔
+func cleanupRemotePartials(remote *Remote, dirs []string) {
+	sep := remote.Sep()
+	for _, dir := range dirs {
+		var entries []os.FileInfo
+		if err := remote.retry(func(client *sftp.Client) (err error) {
+			entries, err = client.ReadDir(dir)
+			return err
+		}); err != nil {
+			continue
+		}
+
+		for _, entry := range entries {
+			if entry.Mode().IsRegular() && isPartialName(entry.Name()) {
+				path := strings.TrimSuffix(dir, sep) + sep + entry.Name()
+				printf("刪除殘留的暫存檔 %s\n", path)
+				remote.retry(func(client *sftp.Client) error {
+					return client.Remove(path)
+				})
+			}
+		}
+	}
+}
+
+// removeLocalPartial 刪除本地目的檔 localPath 上次中斷時留下的暫存檔與分段記錄檔.
+// 單一檔案的複製不會經過 cleanupLocalPartials, 完成後以此刪除它自己的暫存檔.
+func removeLocalPartial(localPath string) {
+	for _, path := range []string{localPartialPath(localPath), localJournalPath(localPath)} {
+		if err := os.Remove(path); err == nil {
+			printf("刪除殘留的暫存檔 %s\n", path)
+		}
+	}
+}
+
+// removeRemotePartial 刪除遠端目的檔 remotePath 上次中斷時留下的暫存檔與分段記錄檔
+func removeRemotePartial(remote *Remote, remotePath string) {
+	sep := remote.Sep()
+	remotePath = util.ReplaceSepWith(remotePath, sep)
+	for _, path := range []string{remotePartialPath(remotePath, sep), remoteJournalPath(remotePath, sep)} {
+		if err := remote.retry(func(client *sftp.Client) error {
+			return client.Remove(path)
+		}); err == nil {
+			printf("刪除殘留的暫存檔 %s\n", path)
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package transport
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFinishRemote(t *testing.T) {
+	mtime := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name       string
+		inplace    bool
+		noTarget   bool // 暫存檔不存在, 設定屬性會失敗
+		wantErr    bool
+		wantData   string
+		wantUpdate bool // 目的檔是否有設定的修改時間與權限
+	}{
+		{name: "暫存檔改名", wantData: "new", wantUpdate: true},
+		{name: "直接寫入", inplace: true, wantData: "new", wantUpdate: true},
+		{name: "設定屬性失敗時不改名", noTarget: true, wantErr: true, wantData: "old"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			remotePath := filepath.ToSlash(filepath.Join(dir, "file"))
+			if err := os.WriteFile(remotePath, []byte("old"), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			target := remotePath
+			if !tt.inplace {
+				target = remotePartialPath(remotePath, "/")
+			}
+			if !tt.noTarget {
+				if err := os.WriteFile(target, []byte("new"), 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			err := finishRemote(newTestRemote(t), target, remotePath, mtime, 0o600)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("finishRemote() 錯誤 = %v, 預期錯誤 %v", err, tt.wantErr)
+			}
+
+			data, err := os.ReadFile(remotePath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != tt.wantData {
+				t.Errorf("目的檔內容 = %q, 預期 %q", data, tt.wantData)
+			}
+			stat, err := os.Stat(remotePath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if updated := stat.ModTime().Equal(mtime) && stat.Mode().Perm() == 0o600; updated != tt.wantUpdate {
+				t.Errorf("目的檔修改時間 %s, 權限 %s, 預期設定了屬性 %v", stat.ModTime(), stat.Mode(), tt.wantUpdate)
+			}
+		})
+	}
+}
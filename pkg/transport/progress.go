@@ -0,0 +1,483 @@
+package transport
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+
+	"scopy/pkg/util"
+
+	"golang.org/x/term"
+)
+
+const (
+	progressRefresh  = 200 * time.Millisecond // 終端機上更新進度的間隔
+	progressInterval = 5 * time.Second        // 不是終端機時, 每隔多久顯示一次進度
+	rateWindow       = 5 * time.Second        // 計算速度時採用最近多久的資料
+	progressBarWidth = 20
+)
+
+// console 協調一般訊息與進度顯示. 顯示訊息前先清除進度, 顯示後再畫回來, 兩者才不會混在同一行.
+var console = struct {
+	sync.Mutex
+	out      *os.File  // 一般訊息與進度顯示的位置
+	progress *progress // 正在終端機上顯示的進度
+}{out: os.Stdout}
+
+// SetMessageOutput 設定一般訊息與進度顯示的位置, 預設為標準輸出. 檔案內容寫到標準輸出時改為標準錯誤.
+func SetMessageOutput(out *os.File) {
+	console.Lock()
+	defer console.Unlock()
+
+	console.out = out
+}
+
+// printf 顯示一般訊息
+func printf(format string, a ...any) {
+	consolePrint(nil, format, a...)
+}
+
+// eprintf 在標準錯誤顯示訊息, 如警告
+func eprintf(format string, a ...any) {
+	consolePrint(os.Stderr, format, a...)
+}
+
+// consolePrint 在 w 顯示訊息, w 為 nil 時顯示在 console.out
+func consolePrint(w io.Writer, format string, a ...any) {
+	console.Lock()
+	defer console.Unlock()
+
+	if w == nil {
+		w = console.out
+	}
+
+	if console.progress != nil {
+		console.progress.clear()
+	}
+	fmt.Fprintf(w, format, a...)
+	if console.progress != nil {
+		console.progress.draw()
+	}
+}
+
+// progress 顯示整個傳輸與每個傳輸中檔案的進度. nil 表示不顯示進度, 所有的方法都可以用在 nil 上.
+type progress struct {
+	tty   bool
+	start time.Time
+	stop  chan struct{}
+	done  chan struct{}
+
+	totalFiles int64
+	totalBytes int64
+
+	mu          sync.Mutex
+	active      []*fileProgress
+	doneFiles   int64
+	doneBytes   int64 // 已經結束 (完成, 失敗或略過) 的檔案的位元組數
+	rate        rate
+	drawnLines  int // 終端機上目前顯示的行數
+	lastPrinted time.Time
+}
+
+// newProgress 建立 files 個檔案, 共 bytes 位元組的傳輸進度, bytes 小於 0 表示不知道大小 (如標準輸入).
+// opts.Progress 為 false 或是模擬執行時傳回 nil.
+func newProgress(files int64, bytes int64, opts TransferOptions) *progress {
+	if !opts.Progress || opts.DryRun {
+		return nil
+	}
+
+	console.Lock()
+	out := console.out
+	console.Unlock()
+
+	p := &progress{
+		tty:        term.IsTerminal(int(out.Fd())),
+		start:      time.Now(),
+		stop:       make(chan struct{}),
+		done:       make(chan struct{}),
+		totalFiles: files,
+		totalBytes: bytes,
+	}
+
+	if p.tty {
+		console.Lock()
+		console.progress = p
+		console.Unlock()
+	}
+	go p.run()
+
+	return p
+}
+
+func (p *progress) run() {
+	defer close(p.done)
+
+	interval := progressInterval
+	if p.tty {
+		interval = progressRefresh
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.stop:
+			return
+		case <-ticker.C:
+			if p.tty {
+				console.Lock()
+				p.clear()
+				p.draw()
+				console.Unlock()
+			} else {
+				printf("%s", strings.Join(p.lines(0), "\n")+"\n")
+			}
+		}
+	}
+}
+
+// finish 停止顯示進度, 並顯示整個傳輸的統計
+func (p *progress) finish() {
+	if p == nil {
+		return
+	}
+
+	close(p.stop)
+	<-p.done
+
+	if p.tty {
+		console.Lock()
+		p.clear()
+		console.progress = nil
+		console.Unlock()
+	}
+
+	p.mu.Lock()
+	bytes, files := p.doneBytes, p.doneFiles
+	p.mu.Unlock()
+
+	elapsed := time.Since(p.start)
+	printf("完成 %d/%d 個檔案, %s, 費時 %s, 平均 %s/s\n", files, p.totalFiles, util.FormatSize(bytes),
+		elapsed.Round(time.Second), util.FormatSize(int64(float64(bytes)/max(elapsed.Seconds(), 0.001))))
+}
+
+// clear 清除終端機上的進度, 呼叫者必須持有 console 的鎖
+func (p *progress) clear() {
+	if p.drawnLines == 0 {
+		return
+	}
+
+	fmt.Fprint(console.out, "\r\033[K")
+	for range p.drawnLines - 1 {
+		fmt.Fprint(console.out, "\033[1A\r\033[K")
+	}
+	p.drawnLines = 0
+}
+
+// draw 在終端機上畫出進度, 游標停在最後一行的結尾. 呼叫者必須持有 console 的鎖.
+func (p *progress) draw() {
+	width, _, err := term.GetSize(int(console.out.Fd()))
+	if err != nil || width <= 0 {
+		width = 80
+	}
+
+	lines := p.lines(width - 1)
+	fmt.Fprint(console.out, strings.Join(lines, "\n"))
+	p.drawnLines = len(lines)
+}
+
+// lines 傳回每個傳輸中的檔案一行, 最後是整體進度. width 大於 0 時截斷超過寬度的檔名.
+func (p *progress) lines(width int) []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	bytes := p.doneBytes
+	var lines []string
+	for _, fp := range p.active {
+		written := fp.written.Load()
+		bytes += written
+		fp.rate.add(now, written)
+
+		var stat string
+		if fp.size < 0 {
+			stat = fmt.Sprintf(" %s %s/s", util.FormatSize(written), util.FormatSize(fp.rate.speed()))
+		} else {
+			stat = fmt.Sprintf(" %3d%% %s/%s %s/s", percent(written, fp.size), util.FormatSize(written), util.FormatSize(fp.size),
+				util.FormatSize(fp.rate.speed()))
+		}
+		lines = append(lines, truncateName(fp.name, width-utf8.RuneCountInString(stat))+stat)
+	}
+	p.rate.add(now, bytes)
+
+	speed := p.rate.speed()
+	if p.totalBytes < 0 {
+		lines = append(lines, fmt.Sprintf("%d/%d 個檔案 %s %s/s", p.doneFiles, p.totalFiles, util.FormatSize(bytes), util.FormatSize(speed)))
+		return lines
+	}
+
+	eta := "--:--"
+	if speed > 0 && p.totalBytes >= bytes {
+		eta = formatETA(time.Duration(float64(p.totalBytes-bytes) / float64(speed) * float64(time.Second)))
+	}
+
+	filled := int(percent(bytes, p.totalBytes)) * progressBarWidth / 100
+	bar := strings.Repeat("=", filled) + strings.Repeat(" ", progressBarWidth-filled)
+	lines = append(lines, fmt.Sprintf("[%s] %3d%% %d/%d 個檔案 %s/%s %s/s 剩餘 %s", bar, percent(bytes, p.totalBytes),
+		p.doneFiles, p.totalFiles, util.FormatSize(bytes), util.FormatSize(p.totalBytes), util.FormatSize(speed), eta))
+
+	return lines
+}
+
+// file 開始一個大小為 size 的檔案的進度
+func (p *progress) file(name string, size int64) *fileProgress {
+	if p == nil {
+		return nil
+	}
+
+	fp := &fileProgress{progress: p, name: name, size: size}
+	p.mu.Lock()
+	p.active = append(p.active, fp)
+	p.mu.Unlock()
+
+	return fp
+}
+
+// skip 記錄略過一個大小為 size 的檔案
+func (p *progress) skip(size int64) {
+	if p == nil {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.doneFiles++
+	p.doneBytes += size
+}
+
+// fileProgress 是一個檔案的進度. 傳輸可能同時寫入多個分段, 所以 written 以原子操作更新.
+type fileProgress struct {
+	progress *progress
+	name     string
+	size     int64
+	written  atomic.Int64
+	rate     rate // 由 progress 在持有鎖時更新
+}
+
+// set 設定已經傳輸的位元組數, 例如續傳或重新連線時
+func (fp *fileProgress) set(written int64) {
+	if fp != nil {
+		fp.written.Store(written)
+	}
+}
+
+// writer 包裝 w, 寫入時更新進度
+func (fp *fileProgress) writer(w io.Writer) io.Writer {
+	if fp == nil {
+		return w
+	}
+
+	return &progressWriter{w: w, fp: fp}
+}
+
+// writerAt 包裝 w, 寫入時更新進度
+func (fp *fileProgress) writerAt(w io.WriterAt) io.WriterAt {
+	if fp == nil {
+		return w
+	}
+
+	return &progressWriterAt{w: w, fp: fp}
+}
+
+// reader 包裝 r, 讀取時更新進度
+func (fp *fileProgress) reader(r io.Reader) io.Reader {
+	if fp == nil {
+		return r
+	}
+
+	return &progressReader{r: r, fp: fp}
+}
+
+// finish 結束這個檔案的進度, 不論成功或失敗
+func (fp *fileProgress) finish() {
+	if fp == nil {
+		return
+	}
+
+	p := fp.progress
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.active = slices.DeleteFunc(p.active, func(active *fileProgress) bool {
+		return active == fp
+	})
+	p.doneFiles++
+	p.doneBytes += fp.written.Load()
+}
+
+type progressWriter struct {
+	w  io.Writer
+	fp *fileProgress
+}
+
+func (w *progressWriter) Write(b []byte) (int, error) {
+	n, err := w.w.Write(b)
+	w.fp.written.Add(int64(n))
+	return n, err
+}
+
+type progressWriterAt struct {
+	w  io.WriterAt
+	fp *fileProgress
+}
+
+func (w *progressWriterAt) WriteAt(b []byte, offset int64) (int, error) {
+	n, err := w.w.WriteAt(b, offset)
+	w.fp.written.Add(int64(n))
+	return n, err
+}
+
+type progressReader struct {
+	r  io.Reader
+	fp *fileProgress
+}
+
+func (r *progressReader) Read(b []byte) (int, error) {
+	n, err := r.r.Read(b)
+	r.fp.written.Add(int64(n))
+	return n, err
+}
+
+// rate 以最近 rateWindow 內的取樣計算速度
+type rate struct {
+	samples []rateSample
+}
+
+type rateSample struct {
+	at    time.Time
+	bytes int64
+}
+
+func (r *rate) add(at time.Time, bytes int64) {
+	r.samples = append(r.samples, rateSample{at: at, bytes: bytes})
+	for len(r.samples) > 2 && at.Sub(r.samples[0].at) > rateWindow {
+		r.samples = r.samples[1:]
+	}
+}
+
+// speed 傳回每秒的位元組數
+func (r *rate) speed() int64 {
+	if len(r.samples) < 2 {
+		return 0
+	}
+
+	first, last := r.samples[0], r.samples[len(r.samples)-1]
+	seconds := last.at.Sub(first.at).Seconds()
+	if seconds <= 0 || last.bytes < first.bytes {
+		return 0
+	}
+
+	return int64(float64(last.bytes-first.bytes) / seconds)
+}
+
+func percent(done int64, total int64) int64 {
+	if total <= 0 {
+		return 100
+	}
+
+	return min(done*100/total, 100)
+}
+
+func formatETA(d time.Duration) string {
+	d = d.Round(time.Second)
+	if d >= time.Hour {
+		return fmt.Sprintf("%d:%02d:%02d", int(d.Hours()), int(d.Minutes())%60, int(d.Seconds())%60)
+	}
+
+	return fmt.Sprintf("%02d:%02d", int(d.Minutes()), int(d.Seconds())%60)
+}
+
+// truncateName 將 name 截短到 width 個字元以內, 保留結尾的部分. width 小於等於 0 時不截斷.
+// 中文字在終端機上佔兩格, 這裡只是粗略的估計.
+func truncateName(name string, width int) string {
+	if width <= 0 {
+		return name
+	}
+
+	runes := []rune(name)
+	cells := 0
+	for _, r := range runes {
+		cells += runeWidth(r)
+	}
+	if cells <= width {
+		return name
+	}
+
+	cells = 0
+	for i := len(runes) - 1; i >= 0; i-- {
+		cells += runeWidth(runes[i])
+		if cells > width-3 {
+			return "..." + string(runes[i+1:])
+		}
+	}
+
+	return "..."
+}
+
+func runeWidth(r rune) int {
+	if r >= 0x1100 {
+		return 2
+	}
+
+	return 1
+}
+
+// scanLocal 計算本地目錄中要傳輸的檔案數與總大小, 排除規則與 uploadLocalDir 相同
+func scanLocal(localDir string, opts TransferOptions) (files int64, bytes int64) {
+	filepath.Walk(localDir, func(localPath string, localInfo os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		if isMatched(localPath, opts.Excludes) {
+			if localInfo.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if localInfo.IsDir() || isPartialName(localInfo.Name()) {
+			return nil
+		}
+
+		if info, err := os.Stat(localPath); err == nil {
+			files++
+			bytes += info.Size()
+		}
+		return nil
+	})
+
+	return files, bytes
+}
+
+// scanRemote 計算遠端目錄中要傳輸的檔案數與總大小, 排除規則與 downloadRemoteDir 相同
+func scanRemote(remote *Remote, remoteDir string, opts TransferOptions) (files int64, bytes int64) {
+	remote.walk(remoteDir, func(remotePath string, remoteStat os.FileInfo) error {
+		if isMatched(remotePath, opts.Excludes) {
+			return errSkipDir
+		}
+		if !remoteStat.IsDir() && !isPartialName(remoteStat.Name()) {
+			files++
+			bytes += remoteStat.Size()
+		}
+		return nil
+	})
+
+	return files, bytes
+}
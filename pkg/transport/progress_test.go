@@ -0,0 +1,132 @@
+package transport
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestProgressLines(t *testing.T) {
+	p := &progress{totalFiles: 3, totalBytes: 300}
+	a := p.file("a.bin", 100)
+	b := p.file("b.bin", 200)
+	a.set(50)
+	b.set(20)
+	p.skip(30)
+
+	// 只有一次取樣, 速度是 0, 不能估計剩餘時間
+	want := []string{
+		"a.bin  50% 50 B/100 B 0 B/s",
+		"b.bin  10% 20 B/200 B 0 B/s",
+		"[======              ]  33% 1/3 個檔案 100 B/300 B 0 B/s 剩餘 --:--",
+	}
+	if got := p.lines(0); !slices.Equal(got, want) {
+		t.Errorf("lines() = %q\n預期 %q", got, want)
+	}
+
+	// 結束的檔案不論成功或失敗, 已經傳輸的位元組都計入整體
+	a.finish()
+	want = []string{
+		"b.bin  10% 20 B/200 B 0 B/s",
+		"[======              ]  33% 2/3 個檔案 100 B/300 B 0 B/s 剩餘 --:--",
+	}
+	if got := p.lines(0); !slices.Equal(got, want) {
+		t.Errorf("finish() 後 lines() = %q\n預期 %q", got, want)
+	}
+
+	stdin := &progress{totalFiles: 1, totalBytes: -1}
+	stdin.file("-", -1).set(2048)
+	want = []string{"- 2.0 KiB 0 B/s", "0/1 個檔案 2.0 KiB 0 B/s"}
+	if got := stdin.lines(0); !slices.Equal(got, want) {
+		t.Errorf("不知道大小時 lines() = %q\n預期 %q", got, want)
+	}
+}
+
+func TestRateSpeed(t *testing.T) {
+	start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	at := func(seconds float64) time.Time {
+		return start.Add(time.Duration(seconds * float64(time.Second)))
+	}
+
+	tests := []struct {
+		name    string
+		samples []rateSample
+		want    int64
+	}{
+		{name: "沒有取樣", want: 0},
+		{name: "只有一次取樣", samples: []rateSample{{at(0), 100}}, want: 0},
+		{name: "固定速度", samples: []rateSample{{at(0), 0}, {at(1), 1000}, {at(2), 2000}}, want: 1000},
+		{name: "只採用最近的取樣", samples: []rateSample{{at(0), 0}, {at(10), 100}, {at(12), 300}, {at(14), 500}}, want: 100},
+		{name: "重新連線後變少", samples: []rateSample{{at(0), 500}, {at(1), 100}}, want: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var r rate
+			for _, s := range tt.samples {
+				r.add(s.at, s.bytes)
+			}
+			if got := r.speed(); got != tt.want {
+				t.Errorf("speed() = %d, 預期 %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFormatETA(t *testing.T) {
+	tests := []struct {
+		d    time.Duration
+		want string
+	}{
+		{0, "00:00"},
+		{1499 * time.Millisecond, "00:01"},
+		{75 * time.Second, "01:15"},
+		{59*time.Minute + 59*time.Second, "59:59"},
+		{2*time.Hour + 3*time.Minute + 4*time.Second, "2:03:04"},
+	}
+
+	for _, tt := range tests {
+		if got := formatETA(tt.d); got != tt.want {
+			t.Errorf("formatETA(%s) = %q, 預期 %q", tt.d, got, tt.want)
+		}
+	}
+}
+
+func TestTruncateName(t *testing.T) {
+	tests := []struct {
+		name  string
+		width int
+		want  string
+	}{
+		{"dir/file.txt", 0, "dir/file.txt"},
+		{"dir/file.txt", 12, "dir/file.txt"},
+		{"dir/file.txt", 10, "...ile.txt"},
+		{"資料/報告.txt", 13, "資料/報告.txt"},
+		{"資料/報告.txt", 12, ".../報告.txt"},
+	}
+
+	for _, tt := range tests {
+		if got := truncateName(tt.name, tt.width); got != tt.want {
+			t.Errorf("truncateName(%q, %d) = %q, 預期 %q", tt.name, tt.width, got, tt.want)
+		}
+	}
+}
+
+func TestPercent(t *testing.T) {
+	tests := []struct {
+		done  int64
+		total int64
+		want  int64
+	}{
+		{0, 100, 0},
+		{50, 200, 25},
+		{300, 200, 100},
+		{0, 0, 100},
+	}
+
+	for _, tt := range tests {
+		if got := percent(tt.done, tt.total); got != tt.want {
+			t.Errorf("percent(%d, %d) = %d, 預期 %d", tt.done, tt.total, got, tt.want)
+		}
+	}
+}
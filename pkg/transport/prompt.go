@@ -0,0 +1,133 @@
+package transport
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+
+	"golang.org/x/term"
+)
+
+// errNoTerminal 需要詢問使用者, 但沒有終端機也沒有其他密碼來源
+var errNoTerminal = errors.New("沒有可用的終端機, 請設定 SSH_ASKPASS 或使用 --password-file, --password-env, --passphrase-file, --passphrase-env")
+
+// readPassword 顯示提示並從終端機讀取一行, 不顯示回顯.
+// 依照 SSH_ASKPASS_REQUIRE 的設定, 沒有終端機時 (或 force, prefer 時) 改由 SSH_ASKPASS 指定的程式詢問.
+func readPassword(prompt string) (string, error) {
+	if useAskpass() {
+		return askpass(prompt)
+	}
+	tty := openTerminal()
+	if tty == nil {
+		return "", fmt.Errorf("%w (%s)", errNoTerminal, strings.TrimSpace(prompt))
+	}
+	defer closeTerminal(tty)
+
+	// 提示顯示在標準錯誤, 標準輸出可能是要複製的資料
+	fmt.Fprint(os.Stderr, prompt)
+	passwordBytes, err := term.ReadPassword(int(tty.Fd()))
+	fmt.Fprintln(os.Stderr) // 讀取完畢後換行
+	if err != nil {
+		return "", err
+	}
+
+	return string(passwordBytes), nil
+}
+
+// readLine 顯示提示並從終端機讀取一行, 會顯示回顯
+func readLine(prompt string) (string, error) {
+	if useAskpass() {
+		return askpass(prompt)
+	}
+	tty := openTerminal()
+	if tty == nil {
+		return "", fmt.Errorf("%w (%s)", errNoTerminal, strings.TrimSpace(prompt))
+	}
+	defer closeTerminal(tty)
+
+	fmt.Fprint(os.Stderr, prompt)
+	line, err := bufio.NewReader(tty).ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// openTerminal 傳回讀取使用者輸入的終端機. 標準輸入不是終端機時 (如從管線上傳) 與 OpenSSH 相同改用 /dev/tty,
+// 都沒有時傳回 nil.
+func openTerminal() *os.File {
+	if term.IsTerminal(int(syscall.Stdin)) {
+		return os.Stdin
+	}
+
+	tty, err := os.Open("/dev/tty")
+	if err != nil {
+		return nil
+	}
+	if !term.IsTerminal(int(tty.Fd())) {
+		tty.Close()
+		return nil
+	}
+
+	return tty
+}
+
+func closeTerminal(tty *os.File) {
+	if tty != os.Stdin {
+		tty.Close()
+	}
+}
+
+// confirm 在終端機詢問使用者, 只有回答 yes 才算同意
+func confirm(prompt string) (bool, error) {
+	for {
+		answer, err := readLine(prompt)
+		if err != nil {
+			return false, err
+		}
+
+		switch strings.ToLower(strings.TrimSpace(answer)) {
+		case "yes":
+			return true, nil
+		case "no":
+			return false, nil
+		}
+		fmt.Fprintln(os.Stderr, "請輸入 yes 或 no.")
+	}
+}
+
+// useAskpass 判斷是否使用 SSH_ASKPASS, 規則與 OpenSSH 的 SSH_ASKPASS_REQUIRE 相同:
+// never 不使用, force 與 prefer 一律使用, 其他情況只在沒有終端機時使用.
+func useAskpass() bool {
+	if os.Getenv("SSH_ASKPASS") == "" {
+		return false
+	}
+
+	switch os.Getenv("SSH_ASKPASS_REQUIRE") {
+	case "never":
+		return false
+	case "force", "prefer":
+		return true
+	}
+
+	return !term.IsTerminal(int(syscall.Stdin))
+}
+
+// askpass 執行 SSH_ASKPASS 指定的程式, 以它的標準輸出作為回答
+func askpass(prompt string) (string, error) {
+	program := os.Getenv("SSH_ASKPASS")
+
+	cmd := exec.Command(program, prompt)
+	cmd.Stderr = os.Stderr
+	output, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("執行 SSH_ASKPASS (%s): %w", program, err)
+	}
+
+	return strings.TrimRight(string(output), "\r\n"), nil
+}
@@ -0,0 +1,331 @@
+package transport
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Dialer 建立到遠端主機的連線. net.Dialer 與 *ssh.Client 都符合這個介面.
+type Dialer interface {
+	Dial(network, addr string) (net.Conn, error)
+}
+
+// NewProxyDialer 依照代理伺服器的網址建立 Dialer, 支援 socks5://[user:pass@]host:port
+// 與 http://[user:pass@]host:port (HTTP CONNECT). forward 為連線到代理伺服器時使用的 Dialer.
+func NewProxyDialer(proxyURL string, forward Dialer) (Dialer, error) {
+	u, err := url.Parse(proxyURL)
+	if err != nil {
+		return nil, fmt.Errorf("代理伺服器網址不正確: %w", err)
+	}
+
+	if u.Host == "" {
+		return nil, fmt.Errorf("代理伺服器網址缺少主機: %s", proxyURL)
+	}
+
+	switch u.Scheme {
+	case "socks5", "socks5h":
+		if u.Port() == "" {
+			u.Host = net.JoinHostPort(u.Hostname(), "1080")
+		}
+		return &socks5Dialer{proxy: u.Host, auth: u.User, forward: forward}, nil
+	case "http":
+		if u.Port() == "" {
+			u.Host = net.JoinHostPort(u.Hostname(), "80")
+		}
+		return &httpConnectDialer{proxy: u.Host, auth: u.User, forward: forward}, nil
+	default:
+		return nil, fmt.Errorf("不支援的代理伺服器類型: %s", u.Scheme)
+	}
+}
+
+// proxiedConn 經由代理建立的連線, RemoteAddr 傳回目的主機而非代理伺服器,
+// 避免主機金鑰被記錄到代理伺服器的位址上.
+type proxiedConn struct {
+	net.Conn
+	reader io.Reader
+	remote net.Addr
+}
+
+func (c *proxiedConn) Read(b []byte) (int, error) {
+	if c.reader != nil {
+		return c.reader.Read(b)
+	}
+	return c.Conn.Read(b)
+}
+
+func (c *proxiedConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// targetAddr 是經由代理連線時的目的位址
+type targetAddr struct {
+	network string
+	addr    string
+}
+
+func (a targetAddr) Network() string { return a.network }
+func (a targetAddr) String() string  { return a.addr }
+
+// socks5Dialer 經由 SOCKS5 代理伺服器連線 (RFC 1928), 支援帳號密碼認證 (RFC 1929).
+// 目的主機名稱交由代理伺服器解析.
+type socks5Dialer struct {
+	proxy   string
+	auth    *url.Userinfo
+	forward Dialer
+}
+
+func (d *socks5Dialer) Dial(network, addr string) (net.Conn, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("埠號不正確: %s", portStr)
+	}
+
+	conn, err := d.forward.Dial("tcp", d.proxy)
+	if err != nil {
+		return nil, fmt.Errorf("連線至 SOCKS5 代理伺服器 %s: %w", d.proxy, err)
+	}
+
+	if err := d.handshake(conn, host, uint16(port)); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("SOCKS5 代理伺服器 %s: %w", d.proxy, err)
+	}
+
+	return &proxiedConn{Conn: conn, remote: targetAddr{network: network, addr: addr}}, nil
+}
+
+func (d *socks5Dialer) handshake(conn net.Conn, host string, port uint16) error {
+	// 協商認證方式: 0x00 不需認證, 0x02 帳號密碼
+	methods := []byte{0x00}
+	if d.auth != nil {
+		methods = append(methods, 0x02)
+	}
+	if _, err := conn.Write(append([]byte{0x05, byte(len(methods))}, methods...)); err != nil {
+		return err
+	}
+
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	if reply[0] != 0x05 {
+		return fmt.Errorf("不是 SOCKS5 伺服器")
+	}
+
+	switch reply[1] {
+	case 0x00:
+	case 0x02:
+		if d.auth == nil {
+			return fmt.Errorf("需要帳號密碼")
+		}
+		username := d.auth.Username()
+		password, _ := d.auth.Password()
+		if len(username) > 255 || len(password) > 255 {
+			return fmt.Errorf("帳號或密碼過長")
+		}
+
+		msg := []byte{0x01, byte(len(username))}
+		msg = append(msg, username...)
+		msg = append(msg, byte(len(password)))
+		msg = append(msg, password...)
+		if _, err := conn.Write(msg); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(conn, reply); err != nil {
+			return err
+		}
+		if reply[1] != 0x00 {
+			return fmt.Errorf("帳號密碼認證失敗")
+		}
+	default:
+		return fmt.Errorf("沒有可接受的認證方式")
+	}
+
+	// CONNECT 請求
+	req := []byte{0x05, 0x01, 0x00}
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			req = append(req, 0x01)
+			req = append(req, ip4...)
+		} else {
+			req = append(req, 0x04)
+			req = append(req, ip.To16()...)
+		}
+	} else {
+		if len(host) > 255 {
+			return fmt.Errorf("主機名稱過長")
+		}
+		req = append(req, 0x03, byte(len(host)))
+		req = append(req, host...)
+	}
+	req = binary.BigEndian.AppendUint16(req, port)
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return err
+	}
+	if header[1] != 0x00 {
+		return fmt.Errorf("連線被拒絕 (代碼 %d)", header[1])
+	}
+
+	// 讀掉伺服器綁定的位址與埠號
+	var addrLen int
+	switch header[3] {
+	case 0x01:
+		addrLen = net.IPv4len
+	case 0x04:
+		addrLen = net.IPv6len
+	case 0x03:
+		lenByte := make([]byte, 1)
+		if _, err := io.ReadFull(conn, lenByte); err != nil {
+			return err
+		}
+		addrLen = int(lenByte[0])
+	default:
+		return fmt.Errorf("無法解析的位址類型 %d", header[3])
+	}
+	_, err := io.ReadFull(conn, make([]byte, addrLen+2))
+
+	return err
+}
+
+// httpConnectDialer 以 HTTP CONNECT 經由 HTTP 代理伺服器建立通道
+type httpConnectDialer struct {
+	proxy   string
+	auth    *url.Userinfo
+	forward Dialer
+}
+
+func (d *httpConnectDialer) Dial(network, addr string) (net.Conn, error) {
+	conn, err := d.forward.Dial("tcp", d.proxy)
+	if err != nil {
+		return nil, fmt.Errorf("連線至 HTTP 代理伺服器 %s: %w", d.proxy, err)
+	}
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if d.auth != nil {
+		password, _ := d.auth.Password()
+		credential := base64.StdEncoding.EncodeToString([]byte(d.auth.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+credential)
+	}
+
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("送出 CONNECT 請求: %w", err)
+	}
+
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("讀取 CONNECT 回應: %w", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("HTTP 代理伺服器 %s 拒絕連線: %s", d.proxy, resp.Status)
+	}
+
+	// 回應之後可能已經讀進 SSH 的資料, 所以要從 reader 繼續讀
+	return &proxiedConn{Conn: conn, reader: reader, remote: targetAddr{network: network, addr: addr}}, nil
+}
+
+// proxyCommandDialer 執行 ProxyCommand, 以它的 stdin/stdout 作為連線
+type proxyCommandDialer struct {
+	command  string
+	username string
+}
+
+// Dial 執行指令. 指令中的 %h, %p, %r, %% 會被替換成主機, 埠號, 使用者名稱與 %.
+func (d *proxyCommandDialer) Dial(network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	replacer := strings.NewReplacer("%%", "%", "%h", host, "%p", port, "%r", d.username)
+	command := replacer.Replace(d.command)
+
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.Command("cmd", "/C", command)
+	} else {
+		cmd = exec.Command("/bin/sh", "-c", command)
+	}
+	cmd.Stderr = os.Stderr
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("執行 ProxyCommand (%s): %w", command, err)
+	}
+
+	return &commandConn{
+		cmd:    cmd,
+		stdin:  stdin,
+		stdout: stdout,
+		remote: targetAddr{network: network, addr: addr},
+	}, nil
+}
+
+// commandConn 將子程序的 stdin/stdout 包裝成 net.Conn
+type commandConn struct {
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stdout io.ReadCloser
+	remote net.Addr
+}
+
+func (c *commandConn) Read(b []byte) (int, error)  { return c.stdout.Read(b) }
+func (c *commandConn) Write(b []byte) (int, error) { return c.stdin.Write(b) }
+
+func (c *commandConn) Close() error {
+	c.stdin.Close()
+	if c.cmd.Process != nil {
+		c.cmd.Process.Kill()
+	}
+	c.cmd.Wait()
+	return nil
+}
+
+func (c *commandConn) LocalAddr() net.Addr  { return targetAddr{network: "pipe", addr: "proxy-command"} }
+func (c *commandConn) RemoteAddr() net.Addr { return c.remote }
+
+// 管線不支援逾時設定
+func (c *commandConn) SetDeadline(t time.Time) error      { return errUnsupportedDeadline }
+func (c *commandConn) SetReadDeadline(t time.Time) error  { return errUnsupportedDeadline }
+func (c *commandConn) SetWriteDeadline(t time.Time) error { return errUnsupportedDeadline }
+
+var errUnsupportedDeadline = errors.New("ProxyCommand 連線不支援逾時設定")
@@ -0,0 +1,409 @@
+package transport
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"scopy/pkg/util"
+
+	"github.com/pkg/sftp"
+)
+
+// CopyRemote 將 src 上的檔案或目錄複製到 dst, 資料經過本地轉送. 目錄的處理方式與 Upload 相同.
+// 任一邊的連線中斷時會重新連線, 從中斷的地方繼續.
+func CopyRemote(
+	src *Remote,
+	srcPath string,
+	dst *Remote,
+	dstPath string,
+	opts TransferOptions,
+) error {
+	var srcInfo os.FileInfo
+	if err := src.retry(func(client *sftp.Client) (err error) {
+		srcInfo, err = client.Stat(srcPath)
+		return err
+	}); err != nil {
+		return fmt.Errorf("取得來源路徑 (%s) 資訊: %w", srcPath, err)
+	}
+
+	opts.limiter = newRateLimiter(opts.LimitRate)
+	stats := &transferStats{}
+	if srcInfo.IsDir() {
+		if opts.Progress && !opts.DryRun {
+			printf("掃描來源目錄 %s\n", srcPath)
+			files, bytes := scanRemote(src, srcPath, opts)
+			stats.progress = newProgress(files, bytes, opts)
+		}
+
+		err := copyRemoteDir(src, srcPath, dst, dstPath, opts, stats)
+		stats.progress.finish()
+		if err != nil {
+			return err
+		}
+	} else {
+		var dstInfo os.FileInfo
+		if err := dst.retry(func(client *sftp.Client) (err error) {
+			dstInfo, err = client.Stat(dstPath)
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}); err != nil {
+			return fmt.Errorf("取得目的路徑 (%s) 資訊: %w", dstPath, err)
+		} else if dstInfo != nil && dstInfo.IsDir() {
+			dstPath = filepath.Join(dstPath, filepath.Base(srcPath))
+		}
+
+		stats.progress = newProgress(1, srcInfo.Size(), opts)
+		err := copyRemoteIfChanged(src, srcPath, srcInfo, dst, dstPath, opts, stats)
+		stats.progress.finish()
+		if err != nil {
+			return err
+		}
+		if !opts.DryRun {
+			removeRemotePartial(dst, dstPath)
+		}
+	}
+
+	if opts.Skip != SkipNone || opts.DryRun {
+		stats.print()
+	}
+
+	if opts.Verify && !opts.DryRun {
+		return stats.verifyResult()
+	}
+
+	return nil
+}
+
+func copyRemoteDir(
+	src *Remote,
+	srcDir string,
+	dst *Remote,
+	dstDir string,
+	opts TransferOptions,
+	stats *transferStats,
+) error {
+	srcDir = util.ReplaceSepWith(srcDir, src.Sep())
+
+	dstRoot := dstDir
+	if dstRoot == "." {
+		dstRoot = filepath.Base(srcDir)
+	}
+
+	var dstDirs []string
+	m := newMirror()
+	pool := newWorkerPool(opts.Jobs)
+	err := src.walk(srcDir, func(srcPath string, srcStat os.FileInfo) error {
+		if isMatched(srcPath, opts.Excludes) {
+			return errSkipDir
+		}
+		if !srcStat.IsDir() && isPartialName(srcStat.Name()) {
+			// 其他 scopy 寫入中的暫存檔
+			return nil
+		}
+
+		relPath, err := filepath.Rel(srcDir, srcPath)
+		if err != nil {
+			return fmt.Errorf("取得相對路徑: %w", err)
+		}
+		// 符號連結指向的目錄沒有走訪內容, 不能據此刪除目的地中對應目錄的內容
+		m.add(relPath, srcStat.IsDir() && !isLinkedDir(srcStat))
+
+		if relPath == "." {
+			var dstStat os.FileInfo
+			if err := dst.retry(func(client *sftp.Client) (err error) {
+				dstStat, err = client.Stat(dstRoot)
+				if os.IsNotExist(err) {
+					return nil
+				}
+				return err
+			}); err != nil {
+				return fmt.Errorf("取得目的目錄資訊: %w", err)
+			}
+
+			if dstStat == nil {
+				opts.printf("建立目的目錄 %s\n", dstRoot)
+				if err := createRemoteDir(dst, dstRoot, opts); err != nil {
+					return fmt.Errorf("建立目的目錄: %w", err)
+				}
+			} else if !dstStat.IsDir() {
+				return fmt.Errorf("目的路徑 (%s) 存在且不是目錄", dstRoot)
+			}
+			dstDirs = append(dstDirs, util.ReplaceSepWith(dstRoot, dst.Sep()))
+		} else {
+			dstPath := filepath.Join(dstRoot, relPath)
+			if srcStat.IsDir() {
+				opts.printf("建立目的目錄 %s\n", dstPath)
+				if err := createRemoteDir(dst, dstPath, opts); err != nil {
+					return fmt.Errorf("建立目的目錄: %w", err)
+				}
+				dstDirs = append(dstDirs, util.ReplaceSepWith(dstPath, dst.Sep()))
+			} else {
+				submitted := pool.submit(func() error {
+					if err := copyRemoteIfChanged(src, srcPath, srcStat, dst, dstPath, opts, stats); err != nil {
+						return fmt.Errorf("複製遠端檔案: %w", err)
+					}
+					return nil
+				})
+				if !submitted {
+					return errTransferStopped
+				}
+			}
+		}
+
+		return nil
+	})
+
+	if err := pool.wait(err); err != nil {
+		return err
+	}
+
+	if opts.Delete {
+		if err := deleteRemoteExtraneous(dst, dstRoot, m, opts); err != nil {
+			return fmt.Errorf("刪除多餘的目的項目: %w", err)
+		}
+	}
+
+	// 全部複製完成後, 剩下的暫存檔都是之前中斷時留下, 而來源已經不存在的檔案
+	if !opts.DryRun {
+		cleanupRemotePartials(dst, dstDirs)
+	}
+
+	return nil
+}
+
+// copyRemoteIfChanged 依照 opts.Skip 判斷是否需要複製, 需要時才將 src 的 srcPath 複製到 dst 的 dstPath
+func copyRemoteIfChanged(
+	src *Remote,
+	srcPath string,
+	srcStat os.FileInfo,
+	dst *Remote,
+	dstPath string,
+	opts TransferOptions,
+	stats *transferStats,
+) error {
+	srcPath = util.ReplaceSepWith(srcPath, src.Sep())
+	dstPath = util.ReplaceSepWith(dstPath, dst.Sep())
+
+	var dstStat os.FileInfo
+	if err := dst.retry(func(client *sftp.Client) (err error) {
+		dstStat, err = client.Stat(dstPath)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}); err != nil {
+		return fmt.Errorf("取得目的檔案 (%s) 資訊: %w", dstPath, err)
+	}
+
+	reason, err := skipReason(srcStat, dstStat, opts, func() (bool, error) {
+		srcSum, err := remoteFileChecksum(src, srcPath)
+		if err != nil {
+			return false, err
+		}
+		dstSum, err := remoteFileChecksum(dst, dstPath)
+		if err != nil {
+			return false, err
+		}
+		return bytes.Equal(srcSum, dstSum), nil
+	})
+	if err != nil {
+		return err
+	} else if reason != "" {
+		opts.printf("略過 %s (%s)\n", dstPath, reason)
+		stats.skipped.Add(1)
+		stats.progress.skip(srcStat.Size())
+		return nil
+	}
+
+	if opts.DryRun {
+		action := "建立"
+		if dstStat != nil {
+			action = "覆蓋"
+		}
+		opts.printf("%s目的檔案 %s (%s)\n", action, dstPath, util.FormatSize(srcStat.Size()))
+	} else {
+		fp := stats.progress.file(dstPath, srcStat.Size())
+		err := copyRemoteFile(src, srcPath, srcStat, dst, dstPath, opts, fp)
+		fp.finish()
+		if err != nil {
+			return err
+		}
+
+		if opts.Verify {
+			srcSum, err := remoteFileChecksum(src, srcPath)
+			if err != nil {
+				return fmt.Errorf("計算來源檔案 (%s) 的檢查碼: %w", srcPath, err)
+			}
+			if err := verifyChecksum(dst, dstPath, src.host+":"+srcPath, srcSum, stats); err != nil {
+				return err
+			}
+		}
+	}
+	stats.copied.Add(1)
+	stats.bytes.Add(srcStat.Size())
+
+	return nil
+}
+
+// copyRemoteFile 將 src 的 srcPath 經由本地複製到 dst 的 dstPath. 與上傳相同, 先寫到暫存檔再改名.
+func copyRemoteFile(
+	src *Remote,
+	srcPath string,
+	srcStat os.FileInfo,
+	dst *Remote,
+	dstPath string,
+	opts TransferOptions,
+	fp *fileProgress,
+) error {
+	dstDir := filepath.Dir(dstPath)
+	if err := remoteMkdirAll(dst, dstDir); err != nil {
+		return fmt.Errorf("建立目的目錄 (%s): %w", dstDir, err)
+	}
+
+	target := dstPath
+	if !opts.Inplace {
+		target = remotePartialPath(dstPath, dst.Sep())
+	}
+
+	printf("複製 %s:%s 至 %s:%s\n", src.host, srcPath, dst.host, dstPath)
+
+	// 來源的連線中斷時重新開啟來源檔案; 目的的連線中斷時重新開啟目的檔案, 兩邊都從已經寫入目的地的位置繼續
+	var written int64
+	if err := src.retry(func(srcClient *sftp.Client) error {
+		srcFile, err := srcClient.Open(srcPath)
+		if err != nil {
+			return fmt.Errorf("開啟來源檔案 (%s): %w", srcPath, err)
+		}
+		defer srcFile.Close()
+
+		return dst.retry(func(dstClient *sftp.Client) error {
+			flags := os.O_WRONLY | os.O_CREATE
+			if written == 0 {
+				flags |= os.O_TRUNC
+			}
+			dstFile, err := dstClient.OpenFile(target, flags)
+			if err != nil {
+				return fmt.Errorf("建立目的檔案 (%s): %w", dstPath, err)
+			}
+			defer dstFile.Close()
+
+			if _, err := srcFile.Seek(written, io.SeekStart); err != nil {
+				return fmt.Errorf("移動來源檔案位置: %w", err)
+			}
+			if _, err := dstFile.Seek(written, io.SeekStart); err != nil {
+				return fmt.Errorf("移動目的檔案位置: %w", err)
+			}
+
+			fp.set(written)
+			// 由來源檔案同時送出多個讀取要求, 不必每一段都等待來回
+			_, err = srcFile.WriteTo(opts.limiter.writer(fp.writer(dstFile)))
+			// 寫入失敗時, 目的檔案的位置停在最後一個確定寫入的位元組之後
+			written, _ = dstFile.Seek(0, io.SeekCurrent)
+			if err != nil {
+				return fmt.Errorf("複製檔案至目的地: %w", err)
+			}
+
+			return nil
+		})
+	}); err != nil {
+		return err
+	}
+
+	return finishRemote(dst, target, dstPath, srcStat.ModTime(), srcStat.Mode())
+}
+
+// CopyDirect 在來源主機上執行 scp, 將 srcPaths 直接推送到 dstHost 的 dstPath, 資料不經過本地.
+// 有多個來源時 dstPath 必須是已經存在的目錄, 由 scp 檢查.
+// 來源主機以轉送的 ssh-agent 向目的主機認證, 所以 src 必須以 ConnectOptions.ForwardAgent 建立.
+// dstHost 與 dstOpts 的意義與 Connect 相同, 先在本地套用 ssh 設定檔, 讓來源主機不必認得本地的 Host 別名.
+// 目的主機的 ProxyJump 與 ProxyCommand 會傳給 scp; 需要 ConnectOptions.Proxy 代理伺服器時傳回錯誤.
+func CopyDirect(
+	src *Remote,
+	srcPaths []string,
+	dstHost string,
+	dstPath string,
+	dstOpts ConnectOptions,
+	opts TransferOptions,
+) error {
+	command, err := directCommand(srcPaths, dstHost, dstPath, dstOpts, opts)
+	if err != nil {
+		return err
+	}
+
+	if opts.DryRun {
+		opts.printf("在 %s 執行 %s\n", src.host, command)
+		return nil
+	}
+
+	session, err := NewSession(src.sshClient(), true)
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	var output bytes.Buffer
+	session.Stdout = &output
+	session.Stderr = &output
+
+	printf("在 %s 執行 %s\n", src.host, command)
+	if err := session.Run(command); err != nil {
+		if msg := strings.TrimSpace(output.String()); msg != "" {
+			return fmt.Errorf("在來源主機執行 scp: %w: %s", err, msg)
+		}
+		return fmt.Errorf("在來源主機執行 scp: %w", err)
+	}
+	printf("已將 %s:%s 複製到 %s:%s\n", src.host, strings.Join(srcPaths, " "), dstHost, dstPath)
+
+	return nil
+}
+
+// directCommand 傳回 CopyDirect 在來源主機執行的 scp 指令
+func directCommand(srcPaths []string, dstHost string, dstPath string, dstOpts ConnectOptions, opts TransferOptions) (string, error) {
+	host, dstOpts, err := applyHostConfig(dstHost, dstOpts)
+	if err != nil {
+		return "", err
+	}
+	if strings.Contains(host, ":") {
+		// IPv6 位址
+		host = "[" + host + "]"
+	}
+
+	// BatchMode 讓來源主機無法認證時直接失敗, 而不是等待沒有人會回答的詢問
+	args := []string{"scp", "-r", "-p", "-o", "BatchMode=yes"}
+	if dstOpts.Port != 0 {
+		args = append(args, "-P", strconv.Itoa(int(dstOpts.Port)))
+	}
+	// 目的主機要經由跳板或 ProxyCommand 連線時, 來源主機的 scp 也照樣連線, 與 Connect 一樣以 ProxyJump 優先.
+	// 這些設定由來源主機的 ssh 解讀, 跳板主機的名稱與 ProxyCommand 中的指令必須在來源主機上有效.
+	hasProxyCommand := dstOpts.ProxyCommand != "" && dstOpts.ProxyCommand != "none"
+	if dstOpts.Proxy != "" && !hasProxyCommand {
+		return "", fmt.Errorf("在來源主機執行的 scp 不能經由代理伺服器 %s 連線到目的主機, 請不要使用 --direct", dstOpts.Proxy)
+	}
+	switch {
+	case dstOpts.ProxyJump != "" && dstOpts.ProxyJump != "none":
+		args = append(args, "-o", "ProxyJump="+dstOpts.ProxyJump)
+	case hasProxyCommand:
+		args = append(args, "-o", "ProxyCommand="+dstOpts.ProxyCommand)
+	}
+	if opts.LimitRate > 0 {
+		// scp 的單位是 Kbit/s
+		args = append(args, "-l", strconv.FormatInt(max(opts.LimitRate*8/1000, 1), 10))
+	}
+	args = append(args, "--")
+	args = append(args, srcPaths...)
+	args = append(args, dstOpts.Username+"@"+host+":"+dstPath)
+
+	var quoted []string
+	for _, arg := range args {
+		quoted = append(quoted, shellQuote(arg))
+	}
+
+	return strings.Join(quoted, " "), nil
+}
@@ -0,0 +1,86 @@
+package transport
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDirectCommand(t *testing.T) {
+	const config = `
+Host web01
+    HostName 10.0.0.5
+    Port 2222
+    ProxyJump bastion
+Host db01
+    ProxyCommand nc -X 5 -x socks:1080 %h %p
+`
+
+	tests := []struct {
+		name    string
+		host    string
+		opts    ConnectOptions
+		limit   int64
+		want    []string // scp 在來源與目的路徑之前的參數
+		wantDst string
+		wantErr bool
+	}{
+		{name: "直接連線", host: "app01", want: []string{}, wantDst: "deploy@app01:/srv"},
+		{name: "IPv6 位址", host: "fe80::1", want: []string{}, wantDst: "deploy@[fe80::1]:/srv"},
+		{name: "設定檔的跳板", host: "web01", want: []string{"-P", "2222", "-o", "ProxyJump=bastion"}, wantDst: "deploy@10.0.0.5:/srv"},
+		{
+			name:    "命令列的跳板優先",
+			host:    "web01",
+			opts:    ConnectOptions{ProxyJump: "gw@gateway:22"},
+			want:    []string{"-P", "2222", "-o", "ProxyJump=gw@gateway:22"},
+			wantDst: "deploy@10.0.0.5:/srv",
+		},
+		{name: "不使用跳板", host: "web01", opts: ConnectOptions{ProxyJump: "none"}, want: []string{"-P", "2222"}, wantDst: "deploy@10.0.0.5:/srv"},
+		{name: "設定檔的 ProxyCommand", host: "db01", want: []string{"-o", "ProxyCommand=nc -X 5 -x socks:1080 %h %p"}, wantDst: "deploy@db01:/srv"},
+		{
+			name:    "ProxyCommand 取代代理伺服器",
+			host:    "app01",
+			opts:    ConnectOptions{ProxyCommand: "connect %h %p", Proxy: "socks5://proxy:1080"},
+			want:    []string{"-o", "ProxyCommand=connect %h %p"},
+			wantDst: "deploy@app01:/srv",
+		},
+		{name: "代理伺服器", host: "web01", opts: ConnectOptions{Proxy: "socks5://proxy:1080"}, wantErr: true},
+		{name: "限制速度", host: "app01", limit: 1 << 20, want: []string{"-l", "8388"}, wantDst: "deploy@app01:/srv"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "config")
+			if err := os.WriteFile(path, []byte(config), 0o600); err != nil {
+				t.Fatalf("寫入設定檔: %v", err)
+			}
+			oldUser, oldGlobal := userSSHConfigFile, globalSSHConfigFile
+			t.Cleanup(func() { userSSHConfigFile, globalSSHConfigFile = oldUser, oldGlobal })
+			userSSHConfigFile, globalSSHConfigFile = path, filepath.Join(t.TempDir(), "missing")
+
+			opts := tt.opts
+			opts.Username = "deploy"
+			got, err := directCommand([]string{"/data/a b"}, tt.host, "/srv", opts, TransferOptions{LimitRate: tt.limit})
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("directCommand() = %s, 預期錯誤", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("directCommand() 錯誤: %v", err)
+			}
+
+			args := append([]string{"scp", "-r", "-p", "-o", "BatchMode=yes"}, tt.want...)
+			args = append(args, "--", "/data/a b", tt.wantDst)
+			var quoted []string
+			for _, arg := range args {
+				quoted = append(quoted, shellQuote(arg))
+			}
+			if want := strings.Join(quoted, " "); got != want {
+				t.Errorf("directCommand() = %s\n預期 %s", got, want)
+			}
+		})
+	}
+}
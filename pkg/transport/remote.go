@@ -0,0 +1,336 @@
+package transport
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"scopy/pkg/util"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// 確認連線是否還在時, 等待 keepalive 回應的時間
+const probeTimeout = 15 * time.Second
+
+// 重新連線之間最長的等待時間
+const maxReconnectDelay = 30 * time.Second
+
+// errSkipDir 由 walk 的 fn 傳回, 表示不必進入這個目錄
+var errSkipDir = errors.New("略過目錄")
+
+// linkedInfo 是 walk 經由符號連結取得的資訊, 也就是連結指向的檔案. walk 不會進入連結指向的目錄.
+type linkedInfo struct {
+	os.FileInfo
+}
+
+// isLinkedDir 判斷 info 是否為 walk 經由符號連結取得, 沒有走訪內容的目錄
+func isLinkedDir(info os.FileInfo) bool {
+	_, ok := info.(linkedInfo)
+	return ok && info.IsDir()
+}
+
+// Remote 是到遠端主機的 SFTP 連線. 連線中斷時會重新連線, 讓進行中的傳輸從中斷的地方繼續.
+type Remote struct {
+	host string
+	opts ConnectOptions
+
+	mu         sync.Mutex
+	ssh        *ssh.Client
+	client     *sftp.Client
+	sep        string
+	generation int // 每次重新連線加 1, 避免多個傳輸同時發現斷線時重複連線
+
+	dialMu sync.Mutex // 重新連線時持有, 只讓一個傳輸重新連線
+
+	peers []*Remote // AddConnections 另外建立的連線
+
+	noHelper    atomic.Bool // 遠端無法執行差異傳輸的輔助程式
+	noSha256sum atomic.Bool // 遠端無法執行 sha256sum
+	noCheckFile atomic.Bool // 伺服器不支援以 check-file 計算 SHA-256
+}
+
+// Dial 連線到 host 並建立 SFTP 客戶端. host 與 opts 的意義與 Connect 相同.
+func Dial(host string, opts ConnectOptions) (*Remote, error) {
+	r := &Remote{host: host, opts: opts, generation: 1}
+	var err error
+	if r.ssh, r.client, r.sep, err = r.dial(); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// dial 建立新的 SSH 與 SFTP 連線, 傳回連線與遠端的路徑分隔符號
+func (r *Remote) dial() (*ssh.Client, *sftp.Client, string, error) {
+	sshClient, err := Connect(r.host, r.opts)
+	if err != nil {
+		return nil, nil, "", err
+	}
+
+	client, err := ToSFTP(sshClient)
+	if err != nil {
+		sshClient.Close()
+		return nil, nil, "", err
+	}
+
+	path, err := client.RealPath(".")
+	if err != nil {
+		client.Close()
+		sshClient.Close()
+		return nil, nil, "", fmt.Errorf("嘗試檢查遠端: %w", err)
+	}
+	sep := "\\"
+	if strings.HasPrefix(path, "/") {
+		sep = "/"
+	}
+
+	return sshClient, client, sep, nil
+}
+
+// Client 傳回目前的 SFTP 客戶端. 重新連線後會是新的客戶端, 所以不要保留它.
+func (r *Remote) Client() *sftp.Client {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.client
+}
+
+// sshClient 傳回目前的 SSH 連線, 與 Client 相同不要保留它
+func (r *Remote) sshClient() *ssh.Client {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.ssh
+}
+
+// Sep 傳回遠端的路徑分隔符號
+func (r *Remote) Sep() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.sep
+}
+
+// Glob 展開遠端路徑 pattern 中的萬用字元 (規則同 path.Match), 傳回依照名稱排序的路徑.
+// pattern 本身存在或沒有萬用字元時直接傳回 pattern, 沒有符合的路徑時傳回空的結果.
+func (r *Remote) Glob(pattern string) ([]string, error) {
+	var matches []string
+	err := r.retry(func(client *sftp.Client) (err error) {
+		if _, err := client.Lstat(pattern); err == nil || !util.HasGlobMeta(pattern) {
+			matches = []string{pattern}
+			return nil
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+
+		matches, err = client.Glob(pattern)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("展開遠端路徑 (%s): %w", pattern, err)
+	}
+	slices.Sort(matches)
+
+	return matches, nil
+}
+
+// AddConnections 另外建立 n 條到同一主機的連線, 讓大檔案的分段分散在多條連線上傳輸.
+// 單一 TCP 連線的頻寬受限時 (如延遲高的網路), 多條連線可以提高總傳輸量.
+func (r *Remote) AddConnections(n int) error {
+	for range n {
+		peer, err := Dial(r.host, r.opts)
+		if err != nil {
+			return err
+		}
+		r.peers = append(r.peers, peer)
+	}
+
+	return nil
+}
+
+// stream 傳回第 idx 個分段使用的連線, 依序輪流使用所有的連線
+func (r *Remote) stream(idx int) *Remote {
+	if idx %= len(r.peers) + 1; idx > 0 {
+		return r.peers[idx-1]
+	}
+
+	return r
+}
+
+// Close 關閉 SFTP 與 SSH 連線, 包括 AddConnections 建立的連線
+func (r *Remote) Close() error {
+	for _, peer := range r.peers {
+		peer.Close()
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.client.Close()
+	return r.ssh.Close()
+}
+
+// retry 執行 op. 失敗的原因是連線中斷時, 重新連線後再執行一次, 所以 op 必須能從上次中斷的地方繼續.
+// 同一個 op 最多重新連線 Reconnects 次 (包括失敗的嘗試), 每次間隔逐漸加長.
+func (r *Remote) retry(op func(client *sftp.Client) error) error {
+	attempts := 0
+	delay := time.Second
+	for {
+		r.mu.Lock()
+		client, generation := r.client, r.generation
+		r.mu.Unlock()
+
+		err := op(client)
+		if err == nil || attempts >= r.opts.Reconnects || !r.lost(generation) {
+			return err
+		}
+		eprintf("[警告] 連線中斷: %v\n", err)
+
+		// 其他傳輸已經重新連線時不必再連
+		for !r.replaced(generation) {
+			if attempts >= r.opts.Reconnects {
+				return fmt.Errorf("無法重新連線至 %s: %w", r.host, err)
+			}
+			attempts++
+			err = r.reconnect(generation, attempts, delay)
+			delay = min(delay*2, maxReconnectDelay)
+		}
+	}
+}
+
+// replaced 判斷第 generation 次建立的連線是否已經被新的連線取代
+func (r *Remote) replaced(generation int) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return generation != r.generation
+}
+
+// lost 判斷第 generation 次建立的連線是否已經中斷. 連線還在但沒有回應時, 關閉它並視為中斷.
+// 等待回應時不持有 r.mu, 其他傳輸仍然可以取得連線.
+func (r *Remote) lost(generation int) bool {
+	r.mu.Lock()
+	sshClient := r.ssh
+	replaced := generation != r.generation
+	r.mu.Unlock()
+	if replaced {
+		// 其他傳輸已經重新連線
+		return true
+	}
+
+	reply := make(chan error, 1)
+	go func() {
+		_, _, err := sshClient.SendRequest("keepalive@openssh.com", true, nil)
+		reply <- err
+	}()
+
+	select {
+	case err := <-reply:
+		if err == nil {
+			return false
+		}
+	case <-time.After(probeTimeout):
+	}
+
+	sshClient.Close()
+	return true
+}
+
+// reconnect 等待 delay 後嘗試重新建立第 generation 次之後的連線, attempt 是第幾次嘗試.
+// 等待與連線時不持有 r.mu, 只在換上新的連線時鎖住. 其他傳輸已經重新連線時直接傳回.
+func (r *Remote) reconnect(generation int, attempt int, delay time.Duration) error {
+	eprintf("%s 後重新連線至 %s (%d/%d)\n", delay, r.host, attempt, r.opts.Reconnects)
+	time.Sleep(delay)
+
+	// 多個傳輸同時斷線時, 一次只讓一個重新連線
+	r.dialMu.Lock()
+	defer r.dialMu.Unlock()
+	if r.replaced(generation) {
+		return nil
+	}
+
+	sshClient, client, sep, err := r.dial()
+	if err != nil {
+		eprintf("[警告] 重新連線失敗: %v\n", err)
+		return err
+	}
+
+	r.mu.Lock()
+	r.client.Close()
+	r.ssh.Close()
+	r.ssh, r.client, r.sep = sshClient, client, sep
+	r.generation++
+	r.mu.Unlock()
+
+	eprintf("已重新連線至 %s\n", r.host)
+	return nil
+}
+
+// walk 依照名稱順序走訪遠端的 root 以及其下所有的檔案與目錄. 每次讀取目錄都可以重新連線,
+// 所以連線中斷時會從中斷的目錄繼續, 不必從頭開始.
+func (r *Remote) walk(root string, fn func(remotePath string, info os.FileInfo) error) error {
+	var info os.FileInfo
+	if err := r.retry(func(client *sftp.Client) (err error) {
+		info, err = client.Stat(root)
+		return err
+	}); err != nil {
+		return fmt.Errorf("取得遠端路徑資訊: %w", err)
+	}
+
+	return r.walkDir(root, info, fn)
+}
+
+func (r *Remote) walkDir(dir string, info os.FileInfo, fn func(remotePath string, info os.FileInfo) error) error {
+	if err := fn(dir, info); err != nil {
+		if errors.Is(err, errSkipDir) {
+			return nil
+		}
+		return err
+	}
+	if !info.IsDir() {
+		return nil
+	}
+
+	var entries []os.FileInfo
+	if err := r.retry(func(client *sftp.Client) (err error) {
+		entries, err = client.ReadDir(dir)
+		return err
+	}); err != nil {
+		return fmt.Errorf("讀取遠端目錄 (%s): %w", dir, err)
+	}
+	slices.SortFunc(entries, func(a, b os.FileInfo) int {
+		return strings.Compare(a.Name(), b.Name())
+	})
+
+	for _, entry := range entries {
+		remotePath := path.Join(dir, entry.Name())
+		if entry.Mode()&os.ModeSymlink == 0 {
+			if err := r.walkDir(remotePath, entry, fn); err != nil {
+				return err
+			}
+			continue
+		}
+
+		// 符號連結以它指向的檔案為準, 但不進入它指向的目錄, 避免循環
+		if err := r.retry(func(client *sftp.Client) (err error) {
+			entry, err = client.Stat(remotePath)
+			return err
+		}); err != nil {
+			eprintf("[警告] 略過無法解析的符號連結 %s: %v\n", remotePath, err)
+			continue
+		}
+		if err := fn(remotePath, linkedInfo{entry}); err != nil && !errors.Is(err, errSkipDir) {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,249 @@
+package transport
+
+import (
+	"net"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// testSSHServer 是本機上的 SSH 伺服器, 提供 sftp 子系統. 作為 ConnectOptions.Dialer 使用,
+// reject 傳回 true 的連線 (從 1 開始編號) 會直接關閉, 模擬無法連線.
+type testSSHServer struct {
+	config   *ssh.ServerConfig
+	listener net.Listener
+	reject   func(n int) bool
+
+	mu    sync.Mutex
+	dials int
+}
+
+func newTestSSHServer(t *testing.T, reject func(n int) bool) *testSSHServer {
+	t.Helper()
+
+	hostKey, err := ssh.NewSignerFromKey(newEd25519Key(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &ssh.ServerConfig{
+		PasswordCallback: func(ssh.ConnMetadata, []byte) (*ssh.Permissions, error) {
+			return nil, nil
+		},
+	}
+	config.AddHostKey(hostKey)
+
+	// net.Pipe 不能用: 雙方一開始都先送出版本字串, 沒有緩衝的管線會互相等待
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	s := &testSSHServer{config: config, listener: listener, reject: reject}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			s.mu.Lock()
+			s.dials++
+			n := s.dials
+			s.mu.Unlock()
+
+			if s.reject != nil && s.reject(n) {
+				conn.Close()
+				continue
+			}
+			go s.serve(conn)
+		}
+	}()
+
+	return s
+}
+
+// Dial 不論 addr 都連線到這個伺服器
+func (s *testSSHServer) Dial(network, addr string) (net.Conn, error) {
+	return net.Dial("tcp", s.listener.Addr().String())
+}
+
+func (s *testSSHServer) dialCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.dials
+}
+
+func (s *testSSHServer) serve(conn net.Conn) {
+	_, chans, reqs, err := ssh.NewServerConn(conn, s.config)
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+
+	for newChannel := range chans {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "")
+			continue
+		}
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			continue
+		}
+		go func() {
+			for req := range requests {
+				if req.Type != "subsystem" {
+					req.Reply(false, nil)
+					continue
+				}
+				req.Reply(true, nil)
+				go func() {
+					defer channel.Close()
+					if server, err := sftp.NewServer(channel); err == nil {
+						server.Serve()
+					}
+				}()
+			}
+		}()
+	}
+}
+
+// dialTestRemote 經由 server 建立 Remote, 不讀取使用者的 ssh 設定檔與 known_hosts
+func dialTestRemote(t *testing.T, server *testSSHServer, reconnects int) *Remote {
+	t.Helper()
+
+	useKnownHosts(t, "")
+	oldUser, oldGlobal := userSSHConfigFile, globalSSHConfigFile
+	t.Cleanup(func() { userSSHConfigFile, globalSSHConfigFile = oldUser, oldGlobal })
+	userSSHConfigFile = filepath.Join(t.TempDir(), "missing")
+	globalSSHConfigFile = userSSHConfigFile
+	t.Setenv("SCOPY_TEST_PASSWORD", "secret")
+
+	r, err := Dial("scopy-test", ConnectOptions{
+		Port:                  22,
+		Username:              "test",
+		ForcePassword:         true,
+		PasswordEnv:           "SCOPY_TEST_PASSWORD",
+		StrictHostKeyChecking: HostKeyCheckNo,
+		NoAgent:               true,
+		Dialer:                server,
+		Reconnects:            reconnects,
+	})
+	if err != nil {
+		t.Fatalf("Dial() 錯誤: %v", err)
+	}
+	t.Cleanup(func() { r.Close() })
+
+	return r
+}
+
+func TestRetryReconnects(t *testing.T) {
+	tests := []struct {
+		name       string
+		reconnects int
+		reject     func(n int) bool
+		wantDials  int // 包括第一次連線
+		wantOps    int
+	}{
+		{name: "不重新連線", reconnects: 0, wantDials: 1, wantOps: 1},
+		{name: "重新連線都成功", reconnects: 2, wantDials: 3, wantOps: 3},
+		{
+			name:       "重新連線交替失敗",
+			reconnects: 2,
+			reject:     func(n int) bool { return n%2 == 0 },
+			wantDials:  3,
+			wantOps:    2,
+		},
+		{
+			name:       "無法重新連線",
+			reconnects: 2,
+			reject:     func(n int) bool { return n > 1 },
+			wantDials:  3,
+			wantOps:    1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newTestSSHServer(t, tt.reject)
+			r := dialTestRemote(t, server, tt.reconnects)
+
+			// op 每次都讓連線中斷, 所以重新連線的次數用完才會結束
+			ops := 0
+			done := make(chan error, 1)
+			go func() {
+				done <- r.retry(func(client *sftp.Client) error {
+					ops++
+					r.sshClient().Close()
+					_, err := client.Getwd()
+					return err
+				})
+			}()
+
+			// 等待與重新連線時不能鎖住連線, 其他傳輸仍然可以取得它
+			for running := true; running; {
+				select {
+				case err := <-done:
+					if err == nil {
+						t.Error("retry() 沒有錯誤")
+					}
+					running = false
+				case <-time.After(50 * time.Millisecond):
+					start := time.Now()
+					r.Client()
+					r.Sep()
+					if elapsed := time.Since(start); elapsed > 200*time.Millisecond {
+						t.Errorf("重新連線時取得連線花了 %s", elapsed)
+					}
+				}
+			}
+
+			if dials := server.dialCount(); dials != tt.wantDials {
+				t.Errorf("連線 %d 次, 預期 %d 次", dials, tt.wantDials)
+			}
+			if ops != tt.wantOps {
+				t.Errorf("執行 op %d 次, 預期 %d 次", ops, tt.wantOps)
+			}
+		})
+	}
+}
+
+func TestRemoteGlob(t *testing.T) {
+	root := t.TempDir()
+	makeTree(t, root, "b.txt", "a.txt", "c.log", "x[1].txt", "logs/")
+	remote := newTestRemote(t)
+	dir := filepath.ToSlash(root) + "/"
+
+	tests := []struct {
+		name    string
+		pattern string
+		want    []string
+	}{
+		{name: "依照名稱排序", pattern: "*.txt", want: []string{"a.txt", "b.txt", "x[1].txt"}},
+		{name: "目錄", pattern: "l*", want: []string{"logs"}},
+		{name: "檔名有萬用字元", pattern: "x[1].txt", want: []string{"x[1].txt"}},
+		{name: "沒有萬用字元", pattern: "missing.txt", want: []string{"missing.txt"}},
+		{name: "沒有符合的路徑", pattern: "*.iso"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var want []string
+			for _, name := range tt.want {
+				want = append(want, dir+name)
+			}
+			got, err := remote.Glob(dir + tt.pattern)
+			if err != nil {
+				t.Fatalf("Glob(%q) 錯誤: %v", tt.pattern, err)
+			}
+			if !slices.Equal(got, want) {
+				t.Errorf("Glob(%q) = %q, 預期 %q", tt.pattern, got, want)
+			}
+		})
+	}
+}
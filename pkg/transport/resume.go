@@ -0,0 +1,54 @@
+package transport
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+)
+
+// 續傳前比對的最後一個區塊大小
+const resumeCheckSize = 1 << 20
+
+// resumeOffset 判斷大小為 dstSize 的目的檔是否為來源檔中斷的複製結果, 傳回可以繼續複製的位置, 0 表示要從頭開始.
+// 目的檔不可以比來源檔大; check 為 true 時另外比對目的檔最後一個區塊與來源檔同一位置的內容.
+// trusted 是分段記錄檔中連續完成的長度, 沒有記錄檔時為 -1. 分段傳輸中斷的目的檔中間可能有還沒寫入的部分, 只能信任這個長度.
+func resumeOffset(name string, dst io.ReaderAt, dstSize int64, trusted int64, src io.ReaderAt, srcSize int64, check bool) (int64, error) {
+	if dstSize > srcSize {
+		printf("%s 比來源檔大, 重新複製\n", name)
+		return 0, nil
+	}
+	if trusted >= 0 && trusted < dstSize {
+		printf("%s 是分段傳輸中斷的結果, 只信任開頭連續完成的 %d 位元組\n", name, trusted)
+		dstSize = trusted
+	}
+	if dstSize == 0 {
+		return 0, nil
+	}
+
+	if check {
+		length := min(resumeCheckSize, dstSize)
+		offset := dstSize - length
+
+		dstBlock := make([]byte, length)
+		if _, err := dst.ReadAt(dstBlock, offset); err != nil && err != io.EOF {
+			return 0, fmt.Errorf("讀取已複製的部分: %w", err)
+		}
+		srcBlock := make([]byte, length)
+		if _, err := src.ReadAt(srcBlock, offset); err != nil && err != io.EOF {
+			return 0, fmt.Errorf("讀取來源檔: %w", err)
+		}
+
+		if !bytes.Equal(dstBlock, srcBlock) {
+			printf("%s 已複製的部分與來源檔不同, 重新複製\n", name)
+			return 0, nil
+		}
+	}
+
+	if dstSize == srcSize {
+		printf("%s 已經複製完成\n", name)
+	} else {
+		printf("續傳 %s, 從 %d 位元組開始\n", name, dstSize)
+	}
+
+	return dstSize, nil
+}
@@ -0,0 +1,52 @@
+package transport
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// readSecret 從檔案或環境變數讀取密碼, 兩者都沒有設定時 ok 為 false.
+// 檔案只取第一行, 方便以 echo 或編輯器建立.
+func readSecret(file string, env string) (secret string, ok bool, err error) {
+	if file != "" {
+		path, err := expandPath(file)
+		if err != nil {
+			return "", false, err
+		}
+
+		buf, err := os.ReadFile(path)
+		if err != nil {
+			return "", false, fmt.Errorf("讀取密碼檔: %w", err)
+		}
+
+		line, _, _ := strings.Cut(string(buf), "\n")
+		return strings.TrimRight(line, "\r"), true, nil
+	}
+
+	if env != "" {
+		secret, ok := os.LookupEnv(env)
+		if !ok {
+			return "", false, fmt.Errorf("環境變數 %s 沒有設定", env)
+		}
+
+		return secret, true, nil
+	}
+
+	return "", false, nil
+}
+
+// staticSecret 是由密碼來源事先提供的密碼. 只會提供一次, 錯誤時不再重試, 避免卡在重試的迴圈.
+type staticSecret struct {
+	value string
+	used  bool
+}
+
+func (s *staticSecret) next() (string, bool) {
+	if s == nil || s.used {
+		return "", false
+	}
+
+	s.used = true
+	return s.value, true
+}
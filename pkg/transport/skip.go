@@ -0,0 +1,195 @@
+package transport
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"sync/atomic"
+
+	"scopy/pkg/util"
+
+	"github.com/pkg/sftp"
+)
+
+// 略過目的檔的規則
+const (
+	SkipNone      = ""          // 一律複製
+	SkipUnchanged = "unchanged" // 大小與修改時間都相同時略過
+	SkipSizeOnly  = "size-only" // 大小相同時略過
+	SkipUpdate    = "update"    // 目的檔比來源檔新, 或是沒有變更時略過
+	SkipExisting  = "existing"  // 目的檔存在就略過
+)
+
+// transferStats 記錄複製與略過的檔案數, 同時傳輸的多個檔案共用
+type transferStats struct {
+	copied  atomic.Int64
+	bytes   atomic.Int64 // 複製的檔案的總大小
+	skipped atomic.Int64
+
+	verified   atomic.Int64 // 比對過檢查碼的檔案數
+	mismatched atomic.Int64 // 檢查碼與來源不同的檔案數
+
+	progress *progress // 不顯示進度時為 nil
+}
+
+// print 顯示複製與略過的檔案數
+func (s *transferStats) print() {
+	printf("複製 %d 個檔案 (%s), 略過 %d 個檔案\n", s.copied.Load(), util.FormatSize(s.bytes.Load()), s.skipped.Load())
+}
+
+// verifyResult 顯示驗證的結果, 有檔案的檢查碼與來源不同時傳回錯誤
+func (s *transferStats) verifyResult() error {
+	if mismatched := s.mismatched.Load(); mismatched > 0 {
+		return fmt.Errorf("%d 個檔案的 SHA-256 與來源不同", mismatched)
+	}
+
+	printf("驗證 %d 個檔案, SHA-256 都與來源相同\n", s.verified.Load())
+	return nil
+}
+
+// skipReason 依照 opts.Skip 比較來源檔 src 與目的檔 dst, 傳回略過的原因, 空字串表示需要複製.
+// same 在 opts.Checksum 為 true 時用來比對兩邊的內容.
+func skipReason(src os.FileInfo, dst os.FileInfo, opts TransferOptions, same func() (bool, error)) (string, error) {
+	if opts.Skip == SkipNone || dst == nil || !dst.Mode().IsRegular() {
+		return "", nil
+	}
+
+	switch opts.Skip {
+	case SkipExisting:
+		return "目的檔已經存在", nil
+	case SkipSizeOnly:
+		if src.Size() == dst.Size() {
+			return "大小相同", nil
+		}
+		return "", nil
+	case SkipUpdate:
+		// SFTP 的時間只到秒
+		if dst.ModTime().Unix() > src.ModTime().Unix() {
+			return "目的檔比較新", nil
+		}
+	}
+
+	if src.Size() != dst.Size() {
+		return "", nil
+	}
+
+	if opts.Checksum {
+		equal, err := same()
+		if err != nil {
+			return "", fmt.Errorf("比對檔案內容: %w", err)
+		}
+		if equal {
+			return "內容相同", nil
+		}
+		return "", nil
+	}
+
+	if src.ModTime().Unix() == dst.ModTime().Unix() {
+		return "沒有變更", nil
+	}
+
+	return "", nil
+}
+
+// skipDownload 判斷是否不必下載 remotePath. remoteStat 是遠端檔案的資訊.
+func skipDownload(remote *Remote, remotePath string, remoteStat os.FileInfo, localPath string, opts TransferOptions) (bool, error) {
+	if opts.Skip == SkipNone {
+		return false, nil
+	}
+
+	localStat, err := os.Stat(localPath)
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, fmt.Errorf("取得本地檔案 (%s) 資訊: %w", localPath, err)
+	}
+
+	reason, err := skipReason(remoteStat, localStat, opts, sameContent(remote, remotePath, localPath))
+	if err != nil || reason == "" {
+		return false, err
+	}
+
+	opts.printf("略過 %s (%s)\n", localPath, reason)
+	return true, nil
+}
+
+// skipUpload 判斷是否不必上傳 localPath. localStat 是本地檔案的資訊.
+func skipUpload(remote *Remote, remotePath string, localPath string, localStat os.FileInfo, opts TransferOptions) (bool, error) {
+	if opts.Skip == SkipNone {
+		return false, nil
+	}
+
+	var remoteStat os.FileInfo
+	if err := remote.retry(func(client *sftp.Client) (err error) {
+		remoteStat, err = client.Stat(remotePath)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}); err != nil {
+		return false, fmt.Errorf("取得遠端檔案 (%s) 資訊: %w", remotePath, err)
+	}
+
+	reason, err := skipReason(localStat, remoteStat, opts, sameContent(remote, remotePath, localPath))
+	if err != nil || reason == "" {
+		return false, err
+	}
+
+	opts.printf("略過 %s (%s)\n", remotePath, reason)
+	return true, nil
+}
+
+// sameContent 傳回比對本地與遠端檔案內容的函式
+func sameContent(remote *Remote, remotePath string, localPath string) func() (bool, error) {
+	return func() (bool, error) {
+		localSum, err := localChecksum(localPath)
+		if err != nil {
+			return false, err
+		}
+		remoteSum, err := remoteFileChecksum(remote, remotePath)
+		if err != nil {
+			return false, err
+		}
+		return bytes.Equal(localSum, remoteSum), nil
+	}
+}
+
+// localChecksum 計算本地檔案的 SHA-256
+func localChecksum(localPath string) ([]byte, error) {
+	file, err := os.Open(localPath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return nil, err
+	}
+
+	return hash.Sum(nil), nil
+}
+
+// remoteChecksum 讀取遠端檔案並計算 SHA-256. 連線中斷時重新連線後從頭計算.
+func remoteChecksum(remote *Remote, remotePath string) ([]byte, error) {
+	var sum []byte
+	err := remote.retry(func(client *sftp.Client) error {
+		file, err := client.Open(remotePath)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+
+		hash := sha256.New()
+		if _, err := file.WriteTo(hash); err != nil {
+			return err
+		}
+		sum = hash.Sum(nil)
+
+		return nil
+	})
+
+	return sum, err
+}
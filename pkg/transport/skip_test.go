@@ -0,0 +1,85 @@
+package transport
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"testing"
+	"time"
+)
+
+// testFileInfo 是只有大小, 修改時間與類型的檔案資訊
+type testFileInfo struct {
+	size  int64
+	mtime time.Time
+	mode  fs.FileMode
+}
+
+func (fi testFileInfo) Name() string       { return "file" }
+func (fi testFileInfo) Size() int64        { return fi.size }
+func (fi testFileInfo) Mode() fs.FileMode  { return fi.mode }
+func (fi testFileInfo) ModTime() time.Time { return fi.mtime }
+func (fi testFileInfo) IsDir() bool        { return fi.mode.IsDir() }
+func (fi testFileInfo) Sys() any           { return nil }
+
+func TestSkipReason(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	file := func(size int64, mtime time.Time) os.FileInfo {
+		return testFileInfo{size: size, mtime: mtime}
+	}
+	src := file(100, now)
+
+	tests := []struct {
+		name     string
+		skip     string
+		checksum bool
+		dst      os.FileInfo
+		same     bool // 比對內容的結果
+		want     string
+		wantErr  bool
+	}{
+		{name: "一律複製", skip: SkipNone, dst: src},
+		{name: "目的檔不存在", skip: SkipExisting},
+		{name: "目的檔是目錄", skip: SkipExisting, dst: testFileInfo{mode: fs.ModeDir}},
+		{name: "existing", skip: SkipExisting, dst: file(1, now.Add(-time.Hour)), want: "目的檔已經存在"},
+		{name: "size-only 大小相同", skip: SkipSizeOnly, dst: file(100, now.Add(-time.Hour)), want: "大小相同"},
+		{name: "size-only 大小不同", skip: SkipSizeOnly, dst: file(99, now)},
+		{name: "unchanged 沒有變更", skip: SkipUnchanged, dst: file(100, now), want: "沒有變更"},
+		{name: "unchanged 只差不到一秒", skip: SkipUnchanged, dst: file(100, now.Add(500*time.Millisecond)), want: "沒有變更"},
+		{name: "unchanged 時間不同", skip: SkipUnchanged, dst: file(100, now.Add(time.Second))},
+		{name: "unchanged 大小不同", skip: SkipUnchanged, dst: file(99, now)},
+		{name: "update 目的檔比較新", skip: SkipUpdate, dst: file(99, now.Add(time.Second)), want: "目的檔比較新"},
+		{name: "update 目的檔比較舊", skip: SkipUpdate, dst: file(100, now.Add(-time.Second))},
+		{name: "update 沒有變更", skip: SkipUpdate, dst: file(100, now), want: "沒有變更"},
+		{name: "checksum 內容相同", skip: SkipUnchanged, checksum: true, dst: file(100, now.Add(-time.Hour)), same: true, want: "內容相同"},
+		{name: "checksum 內容不同", skip: SkipUnchanged, checksum: true, dst: file(100, now)},
+		{name: "checksum 大小不同不比對", skip: SkipUnchanged, checksum: true, dst: file(99, now)},
+		{name: "checksum 比對失敗", skip: SkipUnchanged, checksum: true, dst: file(100, now), wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			compared := false
+			same := func() (bool, error) {
+				compared = true
+				if tt.wantErr {
+					return false, errors.New("讀取失敗")
+				}
+				return tt.same, nil
+			}
+
+			opts := TransferOptions{Skip: tt.skip, Checksum: tt.checksum}
+			got, err := skipReason(src, tt.dst, opts, same)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("skipReason() 錯誤 = %v, 預期錯誤 %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("skipReason() = %q, 預期 %q", got, tt.want)
+			}
+			// 只有指定 --checksum 且大小相同時才需要讀取兩邊的內容
+			if compared && (!tt.checksum || tt.dst.Size() != src.Size()) {
+				t.Error("不必比對內容時卻比對了")
+			}
+		})
+	}
+}
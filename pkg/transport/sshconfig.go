@@ -0,0 +1,373 @@
+package transport
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"scopy/pkg/util"
+)
+
+var (
+	userSSHConfigFile   = "~/.ssh/config"
+	globalSSHConfigFile = "/etc/ssh/ssh_config"
+)
+
+// 防止 Include 互相引用造成無窮遞迴
+const maxIncludeDepth = 16
+
+// HostConfig 是 ssh_config 中套用到某一主機的設定. 與 OpenSSH 相同, 每個選項以第一個出現的值為準,
+// 只有 IdentityFile 與 CertificateFile 會累積.
+type HostConfig struct {
+	HostName            string
+	User                string
+	Port                uint16
+	IdentityFiles       []string
+	CertificateFiles    []string
+	ProxyJump           string
+	ProxyCommand        string
+	ServerAliveInterval time.Duration
+	ServerAliveCountMax int
+	ConnectTimeout      time.Duration
+	Ciphers             string
+	KexAlgorithms       string
+	MACs                string
+	HostKeyAlgorithms   string
+	LimitRate           int64 // scopy 專用的設定, 每秒最多傳輸的位元組數
+}
+
+// sshConfigParser 記錄解析過程中的狀態
+type sshConfigParser struct {
+	alias  string
+	config HostConfig
+	seen   map[string]bool
+}
+
+// LoadHostConfig 讀取 ~/.ssh/config 與 /etc/ssh/ssh_config (含 Include 的檔案), 傳回套用到 alias 的設定.
+// 設定檔不存在時傳回空的設定.
+func LoadHostConfig(alias string) (HostConfig, error) {
+	parser := &sshConfigParser{alias: alias, seen: make(map[string]bool)}
+
+	for _, file := range []string{userSSHConfigFile, globalSSHConfigFile} {
+		path, err := expandPath(file)
+		if err != nil {
+			return HostConfig{}, err
+		}
+
+		if err := parser.parseFile(path, 0); err != nil {
+			return HostConfig{}, err
+		}
+	}
+
+	config := parser.config
+	host := alias
+	if config.HostName != "" {
+		config.HostName = strings.ReplaceAll(config.HostName, "%h", alias)
+		host = config.HostName
+	}
+
+	// 與 OpenSSH 相同, %h 是 HostName 解析後的主機, 設定檔全部讀完才能展開
+	for i, path := range config.IdentityFiles {
+		config.IdentityFiles[i] = expandTokens(path, host)
+	}
+	for i, path := range config.CertificateFiles {
+		config.CertificateFiles[i] = expandTokens(path, host)
+	}
+
+	return config, nil
+}
+
+func (p *sshConfigParser) parseFile(path string, depth int) error {
+	if depth > maxIncludeDepth {
+		return fmt.Errorf("%s: Include 層數過多", path)
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("讀取 ssh 設定檔: %w", err)
+	}
+	defer file.Close()
+
+	// 檔案開頭在任何 Host 之前的設定套用到所有主機
+	active := true
+
+	scanner := bufio.NewScanner(file)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+
+		keyword, rest := splitConfigLine(scanner.Text())
+		if keyword == "" {
+			continue
+		}
+
+		var values []string
+		if keyword == "proxycommand" {
+			// ProxyCommand 交給 shell 執行, 保留原本的引號
+			values = []string{rest}
+		} else if values, err = splitConfigArgs(rest); err != nil {
+			return fmt.Errorf("%s:%d: %w", path, lineNum, err)
+		}
+
+		switch keyword {
+		case "host":
+			active = matchHostPatterns(p.alias, values)
+		case "match":
+			// 只支援 Match all, 其他條件一律視為不符合
+			active = len(values) == 1 && strings.EqualFold(values[0], "all")
+		case "include":
+			if !active {
+				continue
+			}
+			for _, pattern := range values {
+				if err := p.include(pattern, depth); err != nil {
+					return err
+				}
+			}
+		default:
+			if active {
+				if err := p.set(keyword, values); err != nil {
+					return fmt.Errorf("%s:%d: %w", path, lineNum, err)
+				}
+			}
+		}
+	}
+
+	return scanner.Err()
+}
+
+// include 處理 Include 指令, 相對路徑以 ~/.ssh 為基準, 可使用萬用字元
+func (p *sshConfigParser) include(pattern string, depth int) error {
+	pattern, err := expandPath(pattern)
+	if err != nil {
+		return err
+	}
+
+	if !filepath.IsAbs(pattern) {
+		sshDir, err := expandPath("~/.ssh")
+		if err != nil {
+			return err
+		}
+		pattern = filepath.Join(sshDir, pattern)
+	}
+
+	matches, err := filepath.Glob(pattern)
+	if err != nil {
+		return fmt.Errorf("Include %s: %w", pattern, err)
+	}
+
+	for _, match := range matches {
+		if err := p.parseFile(match, depth+1); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (p *sshConfigParser) set(keyword string, values []string) error {
+	if len(values) == 0 {
+		return fmt.Errorf("%s 缺少參數", keyword)
+	}
+
+	switch keyword {
+	case "identityfile":
+		p.config.IdentityFiles = append(p.config.IdentityFiles, values[0])
+		return nil
+	case "certificatefile":
+		p.config.CertificateFiles = append(p.config.CertificateFiles, values[0])
+		return nil
+	}
+
+	if p.seen[keyword] {
+		return nil
+	}
+
+	switch keyword {
+	case "hostname":
+		p.config.HostName = values[0]
+	case "user":
+		p.config.User = values[0]
+	case "port":
+		port, err := strconv.ParseUint(values[0], 10, 16)
+		if err != nil {
+			return fmt.Errorf("Port 不正確: %s", values[0])
+		}
+		p.config.Port = uint16(port)
+	case "proxyjump":
+		p.config.ProxyJump = values[0]
+	case "proxycommand":
+		p.config.ProxyCommand = values[0]
+	case "serveraliveinterval":
+		seconds, err := strconv.ParseUint(values[0], 10, 32)
+		if err != nil {
+			return fmt.Errorf("ServerAliveInterval 不正確: %s", values[0])
+		}
+		p.config.ServerAliveInterval = time.Duration(seconds) * time.Second
+	case "serveralivecountmax":
+		count, err := strconv.ParseUint(values[0], 10, 16)
+		if err != nil {
+			return fmt.Errorf("ServerAliveCountMax 不正確: %s", values[0])
+		}
+		p.config.ServerAliveCountMax = int(count)
+	case "connecttimeout":
+		seconds, err := strconv.ParseUint(values[0], 10, 32)
+		if err != nil {
+			return fmt.Errorf("ConnectTimeout 不正確: %s", values[0])
+		}
+		p.config.ConnectTimeout = time.Duration(seconds) * time.Second
+	case "ciphers":
+		p.config.Ciphers = values[0]
+	case "kexalgorithms":
+		p.config.KexAlgorithms = values[0]
+	case "macs":
+		p.config.MACs = values[0]
+	case "hostkeyalgorithms":
+		p.config.HostKeyAlgorithms = values[0]
+	case "limitrate":
+		limit, err := util.ParseSize(values[0])
+		if err != nil {
+			return fmt.Errorf("LimitRate 不正確: %s", values[0])
+		}
+		p.config.LimitRate = limit
+	default:
+		// 其他選項與 scopy 無關, 略過
+		return nil
+	}
+
+	p.seen[keyword] = true
+	return nil
+}
+
+// splitConfigLine 將一行設定拆成小寫的關鍵字與其餘的部分, 支援 "Keyword value" 與 "Keyword=value" 兩種寫法.
+func splitConfigLine(line string) (string, string) {
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, "#") {
+		return "", ""
+	}
+
+	idx := strings.IndexAny(line, " \t=")
+	if idx < 0 {
+		return strings.ToLower(line), ""
+	}
+
+	keyword := strings.ToLower(line[:idx])
+	rest := strings.TrimLeft(line[idx:], " \t")
+	rest = strings.TrimLeft(strings.TrimPrefix(rest, "="), " \t")
+
+	return keyword, rest
+}
+
+// splitConfigArgs 以空白拆開參數, 雙引號內的空白不拆開
+func splitConfigArgs(s string) ([]string, error) {
+	var (
+		args    []string
+		current strings.Builder
+		inQuote bool
+		hasArg  bool
+	)
+
+	for _, r := range s {
+		switch {
+		case r == '"':
+			inQuote = !inQuote
+			hasArg = true
+		case (r == ' ' || r == '\t') && !inQuote:
+			if hasArg {
+				args = append(args, current.String())
+				current.Reset()
+				hasArg = false
+			}
+		case r == '#' && !inQuote && !hasArg:
+			// 行尾註解
+			return args, nil
+		default:
+			current.WriteRune(r)
+			hasArg = true
+		}
+	}
+
+	if inQuote {
+		return nil, fmt.Errorf("引號沒有成對")
+	}
+	if hasArg {
+		args = append(args, current.String())
+	}
+
+	return args, nil
+}
+
+// matchHostPatterns 判斷 alias 是否符合 Host 的模式. 以 ! 開頭的模式若符合則整行不符合.
+func matchHostPatterns(alias string, patterns []string) bool {
+	matched := false
+	for _, pattern := range patterns {
+		negated := strings.HasPrefix(pattern, "!")
+		pattern = strings.TrimPrefix(pattern, "!")
+
+		if matchWildcard(strings.ToLower(pattern), strings.ToLower(alias)) {
+			if negated {
+				return false
+			}
+			matched = true
+		}
+	}
+
+	return matched
+}
+
+// matchWildcard 比對只有 * 與 ? 兩種萬用字元的模式. 不用 filepath.Match, 因為 [ 在主機模式中沒有特殊意義.
+func matchWildcard(pattern string, s string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			pattern = strings.TrimLeft(pattern, "*")
+			if pattern == "" {
+				return true
+			}
+			for i := 0; i <= len(s); i++ {
+				if matchWildcard(pattern, s[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if s == "" {
+				return false
+			}
+			pattern, s = pattern[1:], s[1:]
+		default:
+			if s == "" || pattern[0] != s[0] {
+				return false
+			}
+			pattern, s = pattern[1:], s[1:]
+		}
+	}
+
+	return s == ""
+}
+
+// expandTokens 展開 IdentityFile 中的 ~ 與 %d, %u, %h, %% 等代號, host 是連線的主機
+func expandTokens(s string, host string) string {
+	home, _ := os.UserHomeDir()
+	localUser := ""
+	if u, err := user.Current(); err == nil {
+		localUser = u.Username
+	}
+
+	replacer := strings.NewReplacer("%%", "%", "%d", home, "%u", localUser, "%h", host)
+	s = replacer.Replace(s)
+
+	if expanded, err := expandPath(s); err == nil {
+		s = expanded
+	}
+
+	return s
+}
@@ -0,0 +1,192 @@
+package transport
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadHostConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  string
+		include string // Include 的檔案內容, 設定檔中以 {include} 代表它的路徑
+		global  string
+		alias   string
+		want    HostConfig
+	}{
+		{
+			name: "主機別名",
+			config: `
+Host web
+    HostName 10.0.0.5
+    User deploy
+    Port 2222
+Host db
+    HostName 10.0.0.6
+`,
+			alias: "web",
+			want:  HostConfig{HostName: "10.0.0.5", User: "deploy", Port: 2222},
+		},
+		{
+			name: "第一個值為準",
+			config: `
+Host web
+    User deploy
+Host *
+    User root
+    Port 2200
+`,
+			alias: "web",
+			want:  HostConfig{User: "deploy", Port: 2200},
+		},
+		{
+			name: "全域設定在後",
+			config: `
+Host *.example.com
+    ConnectTimeout 5
+`,
+			global: `
+Host *
+    ConnectTimeout 30
+    ServerAliveInterval 15
+    ServerAliveCountMax 2
+`,
+			alias: "a.example.com",
+			want:  HostConfig{ConnectTimeout: 5 * time.Second, ServerAliveInterval: 15 * time.Second, ServerAliveCountMax: 2},
+		},
+		{
+			name: "排除模式",
+			config: `
+Host *.example.com !bastion.example.com
+    ProxyJump bastion.example.com
+`,
+			alias: "bastion.example.com",
+			want:  HostConfig{},
+		},
+		{
+			name: "Match all",
+			config: `
+Match host web
+    User nobody
+Match all
+    User deploy
+`,
+			alias: "web",
+			want:  HostConfig{User: "deploy"},
+		},
+		{
+			name: "Include",
+			config: `
+Include {include}
+Host web
+    User root
+`,
+			include: `
+Host web
+    User deploy
+    LimitRate 1M
+`,
+			alias: "web",
+			want:  HostConfig{User: "deploy", LimitRate: 1 << 20},
+		},
+		{
+			name: "等號與引號",
+			config: `
+Host=web
+    HostName=%h.internal
+    ProxyCommand nc -X connect -x "proxy:3128" %h %p
+    Ciphers "aes256-gcm@openssh.com"
+`,
+			alias: "web",
+			want:  HostConfig{HostName: "web.internal", ProxyCommand: `nc -X connect -x "proxy:3128" %h %p`, Ciphers: "aes256-gcm@openssh.com"},
+		},
+		{
+			name: "IdentityFile 累積",
+			config: `
+Host web
+    IdentityFile /keys/%h
+Host *
+    IdentityFile /keys/default
+`,
+			alias: "web",
+			want:  HostConfig{IdentityFiles: []string{"/keys/web", "/keys/default"}},
+		},
+		{
+			name: "%h 是解析後的主機",
+			config: `
+Host web
+    IdentityFile /keys/%h
+    CertificateFile /keys/%h-cert.pub
+    HostName web.internal
+`,
+			alias: "web",
+			want: HostConfig{
+				HostName:         "web.internal",
+				IdentityFiles:    []string{"/keys/web.internal"},
+				CertificateFiles: []string{"/keys/web.internal-cert.pub"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			includePath := filepath.Join(dir, "included")
+			writeConfig := func(name string, content string) string {
+				path := filepath.Join(dir, name)
+				content = strings.ReplaceAll(content, "{include}", includePath)
+				if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+					t.Fatalf("寫入設定檔: %v", err)
+				}
+				return path
+			}
+
+			oldUser, oldGlobal := userSSHConfigFile, globalSSHConfigFile
+			t.Cleanup(func() { userSSHConfigFile, globalSSHConfigFile = oldUser, oldGlobal })
+			userSSHConfigFile = writeConfig("config", tt.config)
+			globalSSHConfigFile = writeConfig("ssh_config", tt.global)
+			writeConfig("included", tt.include)
+
+			got, err := LoadHostConfig(tt.alias)
+			if err != nil {
+				t.Fatalf("LoadHostConfig(%q) 錯誤: %v", tt.alias, err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("LoadHostConfig(%q) = %+v, 預期 %+v", tt.alias, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadHostConfigErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+	}{
+		{"埠號不正確", "Port ssh"},
+		{"缺少參數", "User"},
+		{"引號沒有成對", `Ciphers "aes128-ctr`},
+		{"LimitRate 不正確", "LimitRate fast"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "config")
+			if err := os.WriteFile(path, []byte(tt.config), 0o600); err != nil {
+				t.Fatalf("寫入設定檔: %v", err)
+			}
+
+			oldUser, oldGlobal := userSSHConfigFile, globalSSHConfigFile
+			t.Cleanup(func() { userSSHConfigFile, globalSSHConfigFile = oldUser, oldGlobal })
+			userSSHConfigFile, globalSSHConfigFile = path, filepath.Join(t.TempDir(), "missing")
+
+			if _, err := LoadHostConfig("web"); err == nil {
+				t.Errorf("LoadHostConfig() 沒有錯誤, 設定檔: %q", tt.config)
+			}
+		})
+	}
+}
@@ -0,0 +1,196 @@
+package transport
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"scopy/pkg/util"
+
+	"github.com/pkg/sftp"
+)
+
+// StdioPath 作為本地路徑時代表標準輸入 (上傳) 或標準輸出 (下載), 讓 scopy 可以用在管線中
+const StdioPath = "-"
+
+// 從標準輸入上傳時每次讀取的大小
+const stdinBufferSize = 256 << 10
+
+// downloadToStdout 將遠端檔案 remotePath 寫到標準輸出. 連線中斷時重新開啟遠端檔案, 從已經寫出的位置繼續.
+func downloadToStdout(remote *Remote, remotePath string, remoteInfo os.FileInfo, opts TransferOptions) error {
+	if remoteInfo.IsDir() {
+		return fmt.Errorf("遠端路徑 %s 是目錄, 無法寫到標準輸出", remotePath)
+	}
+	remotePath = util.ReplaceSepWith(remotePath, remote.Sep())
+
+	if opts.DryRun {
+		opts.printf("將遠端檔案 %s 寫到標準輸出 (%s)\n", remotePath, util.FormatSize(remoteInfo.Size()))
+		return nil
+	}
+
+	stats := &transferStats{progress: newProgress(1, remoteInfo.Size(), opts)}
+	fp := stats.progress.file(remotePath, remoteInfo.Size())
+
+	sum := sha256.New()
+	w := io.MultiWriter(opts.limiter.writer(fp.writer(os.Stdout)), sum)
+	var written int64
+	err := remote.retry(func(client *sftp.Client) error {
+		remoteFile, err := client.Open(remotePath)
+		if err != nil {
+			return fmt.Errorf("開啟遠端檔案 (%s): %w", remotePath, err)
+		}
+		defer remoteFile.Close()
+
+		if _, err := remoteFile.Seek(written, io.SeekStart); err != nil {
+			return fmt.Errorf("移動遠端檔案位置: %w", err)
+		}
+
+		// WriteTo 傳回的是已經寫到 w 的位元組數, 失敗時也是
+		n, err := remoteFile.WriteTo(w)
+		written += n
+		if err != nil {
+			return fmt.Errorf("複製遠端檔案至標準輸出: %w", err)
+		}
+
+		return nil
+	})
+	fp.finish()
+	stats.progress.finish()
+	if err != nil {
+		return err
+	}
+
+	if opts.Verify {
+		if err := verifyChecksum(remote, remotePath, "標準輸出", sum.Sum(nil), stats); err != nil {
+			return err
+		}
+		return stats.verifyResult()
+	}
+
+	return nil
+}
+
+// uploadFromStdin 將標準輸入的內容上傳到遠端的 remotePath. 與上傳檔案相同, 先寫到暫存檔, 讀到結尾才改名.
+// 讀取的資料無法重來, 所以逐段寫到遠端的固定位置, 連線中斷時重新開啟遠端檔案再寫一次同一段.
+func uploadFromStdin(remote *Remote, remotePath string, opts TransferOptions) error {
+	var remoteInfo os.FileInfo
+	if err := remote.retry(func(client *sftp.Client) (err error) {
+		remoteInfo, err = client.Stat(remotePath)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}); err != nil {
+		return fmt.Errorf("取得遠端路徑 (%s) 資訊: %w", remotePath, err)
+	} else if remoteInfo != nil && remoteInfo.IsDir() {
+		return fmt.Errorf("遠端路徑 %s 是目錄, 從標準輸入上傳時必須指定檔名", remotePath)
+	}
+	remotePath = util.ReplaceSepWith(remotePath, remote.Sep())
+
+	if opts.DryRun {
+		opts.printf("將標準輸入寫到遠端檔案 %s\n", remotePath)
+		return nil
+	}
+
+	target := remotePath
+	if !opts.Inplace {
+		target = remotePartialPath(remotePath, remote.Sep())
+	}
+
+	stats := &transferStats{progress: newProgress(1, -1, opts)}
+	fp := stats.progress.file(remotePath, -1)
+
+	sum := sha256.New()
+	err := writeStdin(remote, remotePath, target, io.TeeReader(opts.limiter.reader(fp.reader(os.Stdin)), sum))
+	fp.finish()
+	stats.progress.finish()
+	if err != nil {
+		return err
+	}
+
+	if err := remote.retry(func(client *sftp.Client) error {
+		return syncRemote(client, target)
+	}); err != nil {
+		return fmt.Errorf("同步遠端檔案 (%s): %w", remotePath, err)
+	}
+
+	if target != remotePath {
+		if err := remote.retry(func(client *sftp.Client) error {
+			return renameRemote(client, target, remotePath)
+		}); err != nil {
+			return fmt.Errorf("暫存檔改名: %w", err)
+		}
+	}
+
+	if opts.Verify {
+		if err := verifyChecksum(remote, remotePath, "標準輸入", sum.Sum(nil), stats); err != nil {
+			return err
+		}
+		return stats.verifyResult()
+	}
+
+	return nil
+}
+
+// writeStdin 將 src 逐段寫到遠端的 target
+func writeStdin(remote *Remote, remotePath string, target string, src io.Reader) error {
+	printf("建立遠端檔案 %s\n", remotePath)
+
+	var (
+		remoteFile *sftp.File
+		written    int64
+	)
+	defer func() {
+		if remoteFile != nil {
+			remoteFile.Close()
+		}
+	}()
+
+	buf := make([]byte, stdinBufferSize)
+	for {
+		n, readErr := io.ReadFull(src, buf)
+		if n > 0 || remoteFile == nil {
+			if err := remote.retry(func(client *sftp.Client) error {
+				if remoteFile == nil {
+					flags := os.O_WRONLY | os.O_CREATE
+					if written == 0 {
+						flags |= os.O_TRUNC
+					}
+					file, err := client.OpenFile(target, flags)
+					if err != nil {
+						return fmt.Errorf("建立遠端檔案 (%s): %w", remotePath, err)
+					}
+					remoteFile = file
+				}
+
+				if _, err := remoteFile.WriteAt(buf[:n], written); err != nil {
+					// 重新連線後要重新開啟
+					remoteFile.Close()
+					remoteFile = nil
+					return fmt.Errorf("複製標準輸入至遠端: %w", err)
+				}
+				return nil
+			}); err != nil {
+				return err
+			}
+			written += int64(n)
+		}
+
+		if errors.Is(readErr, io.EOF) || errors.Is(readErr, io.ErrUnexpectedEOF) {
+			break
+		} else if readErr != nil {
+			return fmt.Errorf("讀取標準輸入: %w", readErr)
+		}
+	}
+
+	if err := remoteFile.Close(); err != nil {
+		remoteFile = nil
+		return fmt.Errorf("關閉遠端檔案: %w", err)
+	}
+	remoteFile = nil
+	printf("%s: 上傳 %s\n", remotePath, util.FormatSize(written))
+
+	return nil
+}
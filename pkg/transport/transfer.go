@@ -0,0 +1,130 @@
+package transport
+
+import (
+	"errors"
+	"sync"
+)
+
+// errTransferStopped 已經有檔案傳輸失敗, 不必再走訪其他的檔案
+var errTransferStopped = errors.New("傳輸已經停止")
+
+// TransferOptions 下載與上傳時使用的設定
+type TransferOptions struct {
+	Excludes []string // 排除的檔案或目錄模式 (pattern), 可用萬用字元
+	Jobs     int      // 同時傳輸的檔案數, 0 或 1 表示逐一傳輸
+
+	Streams   int   // 大檔案分段同時傳輸的數量, 0 或 1 表示不分段
+	ChunkSize int64 // 每個分段的大小, 比它大的檔案才分段
+
+	Resume      bool // 目的檔是中斷的複製結果時, 從它的結尾繼續
+	ResumeCheck bool // 續傳前比對已複製部分的最後一個區塊
+
+	Inplace bool // 直接寫入目的檔, 不經過暫存檔
+
+	Skip     string // 略過目的檔的規則 (SkipUnchanged 等), 空字串表示一律複製
+	Checksum bool   // 以內容 (SHA-256) 而不是修改時間判斷檔案是否變更
+
+	Delta       bool   // 目的檔存在時只傳送不同的部分, 需要在遠端執行 DeltaHelper
+	DeltaHelper string // 遠端 scopy 的路徑
+
+	Delete       bool // 複製目錄後刪除目的地中來源沒有的項目, 符合 Excludes 的項目除外
+	DeleteDryRun bool // 只列出要刪除的項目, 不真的刪除
+	MaxDelete    int  // 最多刪除的項目數, 超過時一個也不刪除. 0 表示沒有限制
+
+	DryRun bool // 只列出會做的動作, 不修改本地與遠端
+
+	Progress bool // 顯示每個檔案與整體的傳輸進度
+
+	Verify bool // 複製後比對兩邊的 SHA-256, 不同時傳回錯誤
+
+	LimitRate int64 // 所有檔案合計每秒最多傳輸的位元組數, 0 表示不限制
+
+	limiter *rateLimiter // 依照 LimitRate 建立, 同一次傳輸中共用
+}
+
+// printf 顯示一個傳輸的動作. DryRun 時加上標示, 表示只是模擬.
+func (opts TransferOptions) printf(format string, a ...any) {
+	if opts.DryRun {
+		format = "[模擬] " + format
+	}
+	printf(format, a...)
+}
+
+// workerPool 同時執行多個傳輸工作. 工作依照送出的順序編號, 失敗時傳回編號最小的錯誤,
+// 也就是逐一執行時會回報的錯誤, 不會因為執行的快慢而不同.
+type workerPool struct {
+	work chan func()
+	wg   sync.WaitGroup
+
+	mu       sync.Mutex
+	next     int
+	err      error
+	errIndex int
+}
+
+func newWorkerPool(workers int) *workerPool {
+	p := &workerPool{work: make(chan func())}
+	for range max(workers, 1) {
+		go func() {
+			for fn := range p.work {
+				fn()
+			}
+		}()
+	}
+
+	return p
+}
+
+// submit 送出一個工作, 所有 worker 都在忙時會等待. 已經有工作失敗時不再執行新的工作, 傳回 false.
+func (p *workerPool) submit(job func() error) bool {
+	p.mu.Lock()
+	if p.err != nil {
+		p.mu.Unlock()
+		return false
+	}
+	index := p.next
+	p.next++
+	p.mu.Unlock()
+
+	p.wg.Add(1)
+	p.work <- func() {
+		defer p.wg.Done()
+		if err := job(); err != nil {
+			p.fail(index, err)
+		}
+	}
+
+	return true
+}
+
+// stop 記錄送出工作的一方發生的錯誤, 它的順序在所有已經送出的工作之後
+func (p *workerPool) stop(err error) {
+	p.mu.Lock()
+	index := p.next
+	p.next++
+	p.mu.Unlock()
+
+	p.fail(index, err)
+}
+
+func (p *workerPool) fail(index int, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.err == nil || index < p.errIndex {
+		p.err, p.errIndex = err, index
+	}
+}
+
+// wait 等待所有工作結束, 傳回順序最前面的錯誤. walkErr 是送出工作的一方 (如走訪目錄) 結束時的錯誤.
+// 之後不能再送出工作.
+func (p *workerPool) wait(walkErr error) error {
+	if walkErr != nil && !errors.Is(walkErr, errTransferStopped) {
+		p.stop(walkErr)
+	}
+
+	close(p.work)
+	p.wg.Wait()
+
+	return p.err
+}
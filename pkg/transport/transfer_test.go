@@ -0,0 +1,66 @@
+package transport
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestWorkerPool(t *testing.T) {
+	errWalk := errors.New("走訪目錄失敗")
+
+	tests := []struct {
+		name    string
+		jobs    int
+		fails   []int // 失敗的工作編號, 編號越大的工作越快結束
+		walkErr error
+		want    error
+	}{
+		{name: "全部成功", jobs: 8},
+		{name: "一個失敗", jobs: 8, fails: []int{2}, want: errJob(2)},
+		{name: "後面的先失敗", jobs: 4, fails: []int{0, 3}, want: errJob(0)},
+		{name: "工作比走訪先失敗", jobs: 4, fails: []int{1}, walkErr: errWalk, want: errJob(1)},
+		{name: "走訪失敗", jobs: 4, walkErr: errWalk, want: errWalk},
+		{name: "走訪被中止", jobs: 4, fails: []int{3}, walkErr: errTransferStopped, want: errJob(3)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pool := newWorkerPool(4)
+			for i := range tt.jobs {
+				failed := false
+				for _, idx := range tt.fails {
+					failed = failed || idx == i
+				}
+				delay := time.Duration(tt.jobs-i) * 10 * time.Millisecond
+
+				if !pool.submit(func() error {
+					time.Sleep(delay)
+					if failed {
+						return errJob(i)
+					}
+					return nil
+				}) {
+					break
+				}
+			}
+
+			if got := pool.wait(tt.walkErr); !sameError(got, tt.want) {
+				t.Errorf("wait() = %v, 預期 %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// errJob 是第 idx 個工作傳回的錯誤
+func errJob(idx int) error {
+	return fmt.Errorf("工作 %d 失敗", idx)
+}
+
+func sameError(a, b error) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.Error() == b.Error()
+}
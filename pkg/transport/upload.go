@@ -11,56 +11,167 @@ import (
 	"github.com/pkg/sftp"
 )
 
-// Upload 上傳單一檔案或目錄下所有檔案.
+// Upload 上傳單一檔案或目錄下所有檔案. 連線中斷時會重新連線, 從中斷的地方繼續.
+// opts.Jobs 大於 1 時, 目錄中的檔案會同時上傳, 但目錄依照順序建立.
 func Upload(
-	client *sftp.Client,
+	remote *Remote,
 	remotePath string,
 	localPath string,
-	excludes []string,
-	remoteSep string,
+	opts TransferOptions,
 ) error {
+	if localPath == StdioPath {
+		opts.limiter = newRateLimiter(opts.LimitRate)
+		return uploadFromStdin(remote, remotePath, opts)
+	}
+
 	localInfo, err := os.Stat(localPath)
 	if err != nil {
 		return fmt.Errorf("取得本地路徑 (%s) 資訊: %w", localPath, err)
 	}
 
+	opts.limiter = newRateLimiter(opts.LimitRate)
+	stats := &transferStats{}
 	if localInfo.IsDir() {
 		if localPath == "." {
 			localPath, _ = os.Getwd()
 		}
-		return uploadLocalDir(client, remotePath, localPath, excludes, remoteSep)
+		if opts.Progress && !opts.DryRun {
+			printf("掃描本地目錄 %s\n", localPath)
+			files, bytes := scanLocal(localPath, opts)
+			stats.progress = newProgress(files, bytes, opts)
+		}
+
+		err := uploadLocalDir(remote, remotePath, localPath, opts, stats)
+		stats.progress.finish()
+		if err != nil {
+			return err
+		}
 	} else {
-		if remoteInfo, err := client.Stat(remotePath); err != nil {
-			if !os.IsNotExist(err) {
-				return fmt.Errorf("取得遠端路徑 (%s) 資訊: %w", remotePath, err)
+		var remoteInfo os.FileInfo
+		if err := remote.retry(func(client *sftp.Client) (err error) {
+			remoteInfo, err = client.Stat(remotePath)
+			if os.IsNotExist(err) {
+				return nil
 			}
-		} else if remoteInfo.IsDir() {
+			return err
+		}); err != nil {
+			return fmt.Errorf("取得遠端路徑 (%s) 資訊: %w", remotePath, err)
+		} else if remoteInfo != nil && remoteInfo.IsDir() {
 			remotePath = filepath.Join(remotePath, filepath.Base(localPath))
 		}
 
-		return uploadLocalFile(client, remotePath, localPath, remoteSep)
+		stats.progress = newProgress(1, localInfo.Size(), opts)
+		err := uploadIfChanged(remote, remotePath, localPath, opts, stats)
+		stats.progress.finish()
+		if err != nil {
+			return err
+		}
+		if !opts.DryRun {
+			removeRemotePartial(remote, remotePath)
+		}
+	}
+
+	if opts.Skip != SkipNone || opts.DryRun {
+		stats.print()
+	}
+
+	if opts.Verify && !opts.DryRun {
+		return stats.verifyResult()
+	}
+
+	return nil
+}
+
+// uploadIfChanged 依照 opts.Skip 判斷是否需要上傳, 需要時才上傳 localPath
+func uploadIfChanged(
+	remote *Remote,
+	remotePath string,
+	localPath string,
+	opts TransferOptions,
+	stats *transferStats,
+) error {
+	remotePath = util.ReplaceSepWith(remotePath, remote.Sep())
+
+	// 走訪目錄時得到的是符號連結本身的資訊, 所以重新取得它指向的檔案的資訊
+	localStat, err := os.Stat(localPath)
+	if err != nil {
+		return fmt.Errorf("取得本地檔案 (%s) 資訊: %w", localPath, err)
+	}
+
+	if skip, err := skipUpload(remote, remotePath, localPath, localStat, opts); err != nil {
+		return err
+	} else if skip {
+		stats.skipped.Add(1)
+		stats.progress.skip(localStat.Size())
+		return nil
+	}
+
+	if opts.DryRun {
+		var remoteStat os.FileInfo
+		if err := remote.retry(func(client *sftp.Client) (err error) {
+			remoteStat, err = client.Stat(remotePath)
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}); err != nil {
+			return fmt.Errorf("取得遠端檔案 (%s) 資訊: %w", remotePath, err)
+		}
+
+		action := "建立"
+		if remoteStat != nil {
+			action = "覆蓋"
+		}
+		opts.printf("%s遠端檔案 %s (%s)\n", action, remotePath, util.FormatSize(localStat.Size()))
+	} else {
+		fp := stats.progress.file(remotePath, localStat.Size())
+		err := uploadLocalFile(remote, remotePath, localPath, opts, fp)
+		fp.finish()
+		if err != nil {
+			return err
+		}
+
+		if opts.Verify {
+			if err := verifyTransfer(remote, remotePath, localPath, stats); err != nil {
+				return err
+			}
+		}
 	}
+	stats.copied.Add(1)
+	stats.bytes.Add(localStat.Size())
+
+	return nil
 }
 
 func uploadLocalDir(
-	client *sftp.Client,
+	remote *Remote,
 	remoteDir string,
 	localDir string,
-	excludes []string,
-	remoteSep string,
+	opts TransferOptions,
+	stats *transferStats,
 ) error {
 	remoteRoot := remoteDir
 	if remoteRoot == "." {
 		remoteRoot = filepath.Base(localDir)
 	}
 
-	if errWalk := filepath.Walk(localDir, func(localPath string, localInfo os.FileInfo, err error) error {
+	var remoteDirs []string
+	m := newMirror()
+	pool := newWorkerPool(opts.Jobs)
+	errWalk := filepath.Walk(localDir, func(localPath string, localInfo os.FileInfo, err error) error {
 		if err != nil {
 			return fmt.Errorf("掃描本地檔案系統錯誤: %w", err)
 		}
 
-		if isMatched(localPath, excludes) {
+		if isMatched(localPath, opts.Excludes) {
 			// 不用繼續往下做了
+			if localInfo.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !localInfo.IsDir() && isPartialName(localInfo.Name()) {
+			// 其他 scopy 寫入中的暫存檔
 			return nil
 		}
 
@@ -68,46 +179,75 @@ func uploadLocalDir(
 		if err != nil {
 			return fmt.Errorf("取得本地路徑 (%s) 相對路徑: %w", localPath, err)
 		}
+		m.add(relPath, localInfo.IsDir())
 
 		if relPath == "." {
-			if remoteStat, err := client.Stat(remoteRoot); err != nil {
+			var remoteStat os.FileInfo
+			if err := remote.retry(func(client *sftp.Client) (err error) {
+				remoteStat, err = client.Stat(remoteRoot)
 				if os.IsNotExist(err) {
-					fmt.Printf("建立遠端目錄 %s\n", remoteRoot)
-					if err := util.RemoteMkdirAll(client, remoteRoot, remoteSep); err != nil {
-						return fmt.Errorf("建立遠端目錄: %w", err)
-					}
-				} else {
-					return fmt.Errorf("取得遠端目錄資訊: %w", err)
+					return nil
+				}
+				return err
+			}); err != nil {
+				return fmt.Errorf("取得遠端目錄資訊: %w", err)
+			}
+
+			if remoteStat == nil {
+				opts.printf("建立遠端目錄 %s\n", remoteRoot)
+				if err := createRemoteDir(remote, remoteRoot, opts); err != nil {
+					return fmt.Errorf("建立遠端目錄: %w", err)
 				}
 			} else if !remoteStat.IsDir() {
 				return fmt.Errorf("遠端路徑 (%s) 存在且不是目錄", remoteRoot)
 			}
+			remoteDirs = append(remoteDirs, util.ReplaceSepWith(remoteRoot, remote.Sep()))
 		} else {
 			remotePath := filepath.Join(remoteRoot, relPath)
 			if localInfo.IsDir() {
-				fmt.Printf("建立遠端目錄 %s\n", remotePath)
-				if err := util.RemoteMkdirAll(client, remotePath, remoteSep); err != nil {
+				opts.printf("建立遠端目錄 %s\n", remotePath)
+				if err := createRemoteDir(remote, remotePath, opts); err != nil {
 					return fmt.Errorf("建立遠端目錄: %w", err)
 				}
+				remoteDirs = append(remoteDirs, util.ReplaceSepWith(remotePath, remote.Sep()))
 			} else {
-				if err := uploadLocalFile(client, remotePath, localPath, remoteSep); err != nil {
-					return fmt.Errorf("上傳本地檔案: %w", err)
+				submitted := pool.submit(func() error {
+					if err := uploadIfChanged(remote, remotePath, localPath, opts, stats); err != nil {
+						return fmt.Errorf("上傳本地檔案: %w", err)
+					}
+					return nil
+				})
+				if !submitted {
+					return errTransferStopped
 				}
 			}
 		}
 
 		return nil
-	}); errWalk != nil {
-		return errWalk
+	})
+
+	if err := pool.wait(errWalk); err != nil {
+		return err
+	}
+
+	if opts.Delete {
+		if err := deleteRemoteExtraneous(remote, remoteRoot, m, opts); err != nil {
+			return fmt.Errorf("刪除多餘的遠端項目: %w", err)
+		}
+	}
+
+	// 全部上傳完成後, 剩下的暫存檔都是之前中斷時留下, 而來源已經不存在的檔案
+	if !opts.DryRun {
+		cleanupRemotePartials(remote, remoteDirs)
 	}
 
 	return nil
 }
 
-func uploadLocalFile(client *sftp.Client, remotePath string, localPath string, remoteSep string) error {
-	remotePath = util.ReplaceSepWith(remotePath, remoteSep)
+func uploadLocalFile(remote *Remote, remotePath string, localPath string, opts TransferOptions, fp *fileProgress) error {
+	remotePath = util.ReplaceSepWith(remotePath, remote.Sep())
 
-	fmt.Printf("開啟本地檔案 %s\n", localPath)
+	printf("開啟本地檔案 %s\n", localPath)
 	localFile, err := os.Open(localPath)
 	if err != nil {
 		return fmt.Errorf("開啟本地檔案 (%s): %w", localPath, err)
@@ -115,33 +255,147 @@ func uploadLocalFile(client *sftp.Client, remotePath string, localPath string, r
 	defer localFile.Close()
 
 	remoteDir := filepath.Dir(remotePath)
-	if err := util.RemoteMkdirAll(client, remoteDir, remoteSep); err != nil {
+	if err := remoteMkdirAll(remote, remoteDir); err != nil {
 		return fmt.Errorf("建立遠端目錄 (%s): %w", remoteDir, err)
 	}
 
-	fmt.Printf("建立遠端檔案 %s\n", remotePath)
-	remoteFile, err := client.Create(remotePath)
+	localStat, err := localFile.Stat()
 	if err != nil {
-		return fmt.Errorf("建立遠端檔案 (%s): %w", remotePath, err)
+		return fmt.Errorf("取得本地檔案 (%s) 資訊: %w", localPath, err)
+	}
+	chunked := useChunks(localStat.Size(), opts)
+
+	// 先寫到同目錄下的暫存檔, 完成後才改名, 其他程式不會看到只複製一半的檔案
+	target := remotePath
+	if !opts.Inplace {
+		target = remotePartialPath(remotePath, remote.Sep())
+	}
+	journalPath := remoteJournalPath(remotePath, remote.Sep())
+
+	// 連線中斷後重新開啟遠端檔案, 從已經寫入遠端的位置繼續
+	var (
+		written int64
+		opened  bool
+	)
+	if err := remote.retry(func(client *sftp.Client) error {
+		var (
+			remoteFile *sftp.File
+			err        error
+		)
+
+		// 遠端已經有舊檔案時只上傳不同的部分
+		if !opened && opts.Delta && !opts.Inplace {
+			if delta, err := uploadDelta(remote, localFile, remotePath, target, opts, fp); err != nil {
+				eprintf("[警告] 差異上傳 %s 失敗, 改為完整上傳: %v\n", remotePath, err)
+			} else if delta {
+				opened, chunked = true, false
+				return nil
+			}
+		}
+
+		switch {
+		case opened:
+			printf("從 %d 位元組繼續上傳 %s\n", written, remotePath)
+			remoteFile, err = client.OpenFile(target, os.O_WRONLY)
+		case opts.Resume:
+			remoteFile, err = client.OpenFile(target, os.O_RDWR|os.O_CREATE)
+		default:
+			printf("建立遠端檔案 %s\n", remotePath)
+			remoteFile, err = client.Create(target)
+		}
+		if err != nil {
+			return fmt.Errorf("建立遠端檔案 (%s): %w", remotePath, err)
+		}
+		defer remoteFile.Close()
+
+		if !opened && opts.Resume {
+			if written, err = resumeRemote(client, remotePath, journalPath, remoteFile, localFile, localStat.Size(), opts); err != nil {
+				return err
+			}
+		}
+		opened = true
+
+		// 大檔案改為分段同時上傳
+		if chunked {
+			fp.set(written)
+			return nil
+		}
+
+		if _, err := remoteFile.Seek(written, io.SeekStart); err != nil {
+			return fmt.Errorf("移動遠端檔案位置: %w", err)
+		}
+		if _, err := localFile.Seek(written, io.SeekStart); err != nil {
+			return fmt.Errorf("移動本地檔案位置: %w", err)
+		}
+
+		fp.set(written)
+		_, err = io.Copy(remoteFile, opts.limiter.reader(fp.reader(localFile)))
+		// 寫入失敗時, 遠端檔案的位置停在最後一個確定寫入的位元組之後
+		written, _ = remoteFile.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return fmt.Errorf("複製檔案至遠端: %w", err)
+		}
+
+		return nil
+	}); err != nil {
+		return err
 	}
-	defer remoteFile.Close()
 
-	_, err = io.Copy(remoteFile, localFile)
+	if chunked {
+		if err := uploadChunks(remote, target, localFile, journalPath, localStat.Size(), written, opts, fp); err != nil {
+			return err
+		}
+	}
+
+	return finishRemote(remote, target, remotePath, localStat.ModTime(), localStat.Mode())
+}
+
+// resumeRemote 判斷遠端檔案是否為 localFile 中斷的上傳結果, 傳回可以繼續的位置. 不能續傳時清空遠端檔案,
+// 有分段記錄檔時截短到記錄中連續完成的部分.
+func resumeRemote(client *sftp.Client, remotePath string, journalPath string, remoteFile *sftp.File, localFile *os.File, size int64, opts TransferOptions) (int64, error) {
+	remoteStat, err := remoteFile.Stat()
 	if err != nil {
-		return fmt.Errorf("複製檔案至遠端: %w", err)
+		return 0, fmt.Errorf("取得遠端檔案 (%s) 資訊: %w", remotePath, err)
+	}
+
+	trusted, journaled := readRemoteJournal(client, journalPath)
+	if !journaled {
+		trusted = -1
 	}
 
-	localStat, err := client.Stat(localPath)
+	offset, err := resumeOffset(remotePath, remoteFile, remoteStat.Size(), trusted, localFile, size, opts.ResumeCheck)
 	if err != nil {
-		// 只是無法複製屬性, 不管它
-		return nil
+		return 0, err
+	}
+
+	if offset < remoteStat.Size() {
+		if offset == 0 {
+			printf("建立遠端檔案 %s\n", remotePath)
+		}
+		if err := remoteFile.Truncate(offset); err != nil {
+			return 0, fmt.Errorf("截短遠端檔案 (%s): %w", remotePath, err)
+		}
+	}
+	// 截短後只剩連續完成的部分, 不再需要記錄檔
+	if journaled {
+		client.Remove(journalPath)
 	}
 
-	mtime := localStat.ModTime()
-	client.Chtimes(localPath, mtime, mtime)
+	return offset, nil
+}
+
+// createRemoteDir 建立遠端目錄. DryRun 時不做任何事.
+func createRemoteDir(remote *Remote, remoteDir string, opts TransferOptions) error {
+	if opts.DryRun {
+		return nil
+	}
 
-	mode := localStat.Mode()
-	client.Chmod(localPath, mode)
+	return remoteMkdirAll(remote, remoteDir)
+}
 
-	return nil
+// remoteMkdirAll 建立遠端目錄以及所有上層目錄, 連線中斷時重新連線後繼續
+func remoteMkdirAll(remote *Remote, remoteDir string) error {
+	return remote.retry(func(client *sftp.Client) error {
+		return util.RemoteMkdirAll(client, remoteDir, remote.Sep())
+	})
 }
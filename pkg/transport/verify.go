@@ -0,0 +1,134 @@
+package transport
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+
+	"scopy/pkg/util"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// errBadSha256sumOutput 表示遠端 sha256sum 的輸出不是預期的格式
+var errBadSha256sumOutput = errors.New("sha256sum 的輸出不正確")
+
+// verifyTransfer 比對複製完成的本地與遠端檔案的 SHA-256. 不同時顯示錯誤並記錄在 stats, 繼續複製其他的檔案.
+func verifyTransfer(remote *Remote, remotePath string, localPath string, stats *transferStats) error {
+	remotePath = util.ReplaceSepWith(remotePath, remote.Sep())
+
+	localSum, err := localChecksum(localPath)
+	if err != nil {
+		return fmt.Errorf("計算本地檔案 (%s) 的檢查碼: %w", localPath, err)
+	}
+
+	return verifyChecksum(remote, remotePath, localPath, localSum, stats)
+}
+
+// verifyChecksum 比對本地資料的 SHA-256 localSum 與遠端檔案 remotePath 的 SHA-256. name 是本地資料在訊息中的名稱.
+func verifyChecksum(remote *Remote, remotePath string, name string, localSum []byte, stats *transferStats) error {
+	remoteSum, err := remoteFileChecksum(remote, remotePath)
+	if err != nil {
+		return fmt.Errorf("計算遠端檔案 (%s) 的檢查碼: %w", remotePath, err)
+	}
+
+	stats.verified.Add(1)
+	if !bytes.Equal(localSum, remoteSum) {
+		stats.mismatched.Add(1)
+		eprintf("[錯誤] %s 與 %s 的 SHA-256 不同 (%x, %x)\n", name, remotePath, localSum, remoteSum)
+		return nil
+	}
+
+	printf("驗證 %s: SHA-256 相同\n", name)
+	return nil
+}
+
+// remoteFileChecksum 計算遠端檔案的 SHA-256, 盡量不必把檔案傳回來: 伺服器支援 SFTP 的 check-file 擴充功能時由伺服器計算,
+// 否則在遠端執行 sha256sum. 遠端沒有 sha256sum 時顯示一次警告, 之後都改為經由 SFTP 讀取整個檔案計算;
+// 連線中斷等其他錯誤只有這個檔案改為讀取計算.
+func remoteFileChecksum(remote *Remote, remotePath string) ([]byte, error) {
+	if !remote.noCheckFile.Load() {
+		sum, err := remoteCheckFile(remote, remotePath)
+		if err == nil {
+			return sum, nil
+		}
+		if errors.Is(err, errCheckFileUnsupported) {
+			remote.noCheckFile.Store(true)
+		}
+	}
+
+	if !remote.noSha256sum.Load() {
+		sum, err := remoteSha256sum(remote, remotePath)
+		if err == nil {
+			return sum, nil
+		}
+		if sha256sumUnavailable(err) && remote.noSha256sum.CompareAndSwap(false, true) {
+			eprintf("[警告] 無法在遠端執行 sha256sum, 改為讀取遠端檔案計算: %v\n", err)
+		}
+	}
+
+	return remoteChecksum(remote, remotePath)
+}
+
+// sha256sumUnavailable 判斷 remoteSha256sum 的錯誤是否表示遠端無法執行 sha256sum (沒有這個指令, 不允許執行指令,
+// 輸出的格式不同), 而不是連線中斷或個別檔案 (如沒有權限讀取) 的錯誤
+func sha256sumUnavailable(err error) bool {
+	if errors.Is(err, errBadSha256sumOutput) {
+		return true
+	}
+
+	var openErr *ssh.OpenChannelError
+	if errors.As(err, &openErr) {
+		return true
+	}
+
+	var exitErr *ssh.ExitError
+	if !errors.As(err, &exitErr) {
+		return false
+	}
+	// 126: 無法執行, 127: 找不到指令. Windows 的 cmd 找不到指令時傳回 1, 只能從訊息判斷
+	if status := exitErr.ExitStatus(); status == 126 || status == 127 {
+		return true
+	}
+	msg := strings.ToLower(err.Error())
+	return strings.Contains(msg, "not found") || strings.Contains(msg, "not recognized")
+}
+
+// remoteSha256sum 在遠端執行 sha256sum 計算 remotePath 的 SHA-256
+func remoteSha256sum(remote *Remote, remotePath string) ([]byte, error) {
+	session, err := NewSession(remote.sshClient(), false)
+	if err != nil {
+		return nil, err
+	}
+	defer session.Close()
+
+	var stderr bytes.Buffer
+	session.Stderr = &stderr
+	out, err := session.Output("sha256sum -- " + shellQuote(remotePath))
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, fmt.Errorf("%w: %s", err, msg)
+		}
+		return nil, err
+	}
+
+	// 輸出的格式為 "<十六進位的檢查碼>  <檔名>"
+	fields := strings.Fields(string(out))
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("%w: %q", errBadSha256sumOutput, out)
+	}
+	sum, err := hex.DecodeString(strings.TrimPrefix(fields[0], "\\"))
+	if err != nil || len(sum) != sha256.Size {
+		return nil, fmt.Errorf("%w: %q", errBadSha256sumOutput, out)
+	}
+
+	return sum, nil
+}
+
+// shellQuote 以單引號包住 s, 讓遠端的 shell 把它當成一個參數
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
@@ -33,3 +33,8 @@ func isExcluded(base string, excludes []string) bool {
 
 	return false
 }
+
+// HasGlobMeta 判斷路徑中是否有萬用字元 (*, ?, [)
+func HasGlobMeta(path string) bool {
+	return strings.ContainsAny(path, "*?[")
+}
@@ -0,0 +1,61 @@
+package util
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// ParseSize 解析位元組數, 可以加上 K, M, G, T 單位 (以 1024 為基數), 如 64M 或 1.5G
+func ParseSize(s string) (int64, error) {
+	value := strings.ToUpper(strings.TrimSpace(s))
+	value = strings.TrimSuffix(strings.TrimSuffix(value, "B"), "I")
+
+	multiplier := int64(1)
+	if value != "" {
+		switch value[len(value)-1] {
+		case 'K':
+			multiplier = 1 << 10
+		case 'M':
+			multiplier = 1 << 20
+		case 'G':
+			multiplier = 1 << 30
+		case 'T':
+			multiplier = 1 << 40
+		}
+		if multiplier > 1 {
+			value = value[:len(value)-1]
+		}
+	}
+
+	number, err := strconv.ParseFloat(value, 64)
+	if err != nil || math.IsNaN(number) || number < 0 {
+		return 0, fmt.Errorf("大小不正確: %s", s)
+	}
+
+	// float64(math.MaxInt64) 是 2^63, 等於它的值已經超出 int64; 也排除了 Inf
+	size := number * float64(multiplier)
+	if size >= math.MaxInt64 {
+		return 0, fmt.Errorf("大小超出範圍: %s", s)
+	}
+
+	return int64(size), nil
+}
+
+// FormatSize 將位元組數轉成容易閱讀的字串 (以 1024 為基數), 如 1.5 MiB
+func FormatSize(size int64) string {
+	if size < 1<<10 {
+		return fmt.Sprintf("%d B", size)
+	}
+
+	value := float64(size)
+	for _, unit := range []string{"KiB", "MiB", "GiB", "TiB"} {
+		value /= 1024
+		if value < 1024 || unit == "TiB" {
+			return fmt.Sprintf("%.1f %s", value, unit)
+		}
+	}
+
+	return ""
+}
@@ -0,0 +1,74 @@
+package util
+
+import "testing"
+
+func TestParseSize(t *testing.T) {
+	tests := []struct {
+		s       string
+		want    int64
+		wantErr bool
+	}{
+		{s: "0", want: 0},
+		{s: "512", want: 512},
+		{s: "64K", want: 64 << 10},
+		{s: "64k", want: 64 << 10},
+		{s: "64M", want: 64 << 20},
+		{s: "64MB", want: 64 << 20},
+		{s: "64MiB", want: 64 << 20},
+		{s: "1.5G", want: 3 << 29},
+		{s: "2T", want: 2 << 40},
+		{s: " 8M ", want: 8 << 20},
+		{s: "100B", want: 100},
+		{s: "", wantErr: true},
+		{s: "M", wantErr: true},
+		{s: "-1M", wantErr: true},
+		{s: "fast", wantErr: true},
+		{s: "10X", wantErr: true},
+		{s: "nan", wantErr: true},
+		{s: "NaNK", wantErr: true},
+		{s: "inf", wantErr: true},
+		{s: "+Inf", wantErr: true},
+		{s: "-inf", wantErr: true},
+		{s: "1e30", wantErr: true},
+		{s: "8388608T", wantErr: true},
+		{s: "8388607T", want: 8388607 << 40},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.s, func(t *testing.T) {
+			got, err := ParseSize(tt.s)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("ParseSize(%q) = %d, 預期錯誤", tt.s, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseSize(%q) 錯誤: %v", tt.s, err)
+			}
+			if got != tt.want {
+				t.Errorf("ParseSize(%q) = %d, 預期 %d", tt.s, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFormatSize(t *testing.T) {
+	tests := []struct {
+		size int64
+		want string
+	}{
+		{0, "0 B"},
+		{1023, "1023 B"},
+		{1024, "1.0 KiB"},
+		{3 << 19, "1.5 MiB"},
+		{5 << 30, "5.0 GiB"},
+		{2048 << 40, "2048.0 TiB"},
+	}
+
+	for _, tt := range tests {
+		if got := FormatSize(tt.size); got != tt.want {
+			t.Errorf("FormatSize(%d) = %q, 預期 %q", tt.size, got, tt.want)
+		}
+	}
+}